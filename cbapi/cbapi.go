@@ -1,24 +1,182 @@
 package cbapi
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	tr     = &http.Transport{}
-	client = &http.Client{
-		Transport: tr,
-		Timeout:   5 * time.Second,
-	}
+	tr          = &http.Transport{}
+	client      = &http.Client{Transport: tr}
+	clientMutex sync.RWMutex
 )
 
-// Auth Generic Authentication holder
+// ClusterTimeout Limit of the cluster manager and XDCR requests, the query
+// node requests are only limited by the context of the caller
+const ClusterTimeout = 5 * time.Second
+
+// TLSConfig Certificates used to connect to the clusters over HTTPS
+type TLSConfig struct {
+	CAFile             string `json:"cafile"`
+	CertFile           string `json:"certfile"`
+	KeyFile            string `json:"keyfile"`
+	InsecureSkipVerify bool   `json:"insecureskipverify"`
+}
+
+func httpClient() *http.Client {
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
+	return client
+}
+
+// SetTLSConfig replaces the certificates used by the HTTPS requests
+func SetTLSConfig(config TLSConfig) error {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	tr.CloseIdleConnections()
+	tr = &http.Transport{TLSClientConfig: tlsConfig}
+	client = &http.Client{Transport: tr}
+	return nil
+}
+
+// Auth Generic Authentication holder, the files take precedence over the
+// literal values and are read again when they change
 type Auth struct {
-	Username string
-	Password string
+	Username     string
+	Password     string
+	UsernameFile string
+	PasswordFile string
+}
+
+type secretFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+var (
+	secrets       = make(map[string]secretFile)
+	secretsFailed = make(map[string]bool) // Files whose last read failed, logged once
+	secretsMutex  sync.Mutex
+)
+
+// ReadSecret returns the content of a secret file without the trailing new
+// line, the file is only read again when it changes. The last value read is
+// kept if the file cannot be read anymore.
+func ReadSecret(path string) (string, error) {
+	value, _, err := readSecret(path)
+	return value, err
+}
+
+// readSecret returns the content of a secret file and whether it was ever read
+func readSecret(path string) (string, bool, error) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	cached, found := secrets[path]
+	info, err := os.Stat(path)
+	if err != nil {
+		return cached.value, found, err
+	}
+	if found && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, true, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cached.value, found, err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	secrets[path] = secretFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		value:   value,
+	}
+	return value, true, nil
+}
+
+// credential reads a secret file, logging once why it cannot be read until it
+// is read again. It fails when the file was never read.
+func credential(name string, path string) (string, error) {
+	value, found, err := readSecret(path)
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	if err == nil {
+		delete(secretsFailed, path)
+		return value, nil
+	}
+	if !secretsFailed[path] {
+		secretsFailed[path] = true
+		if found {
+			log.Printf("Cannot read %s file %s, using its last value: %s\n", name, path, err.Error())
+		} else {
+			log.Printf("Cannot read %s file %s, skipping the requests: %s\n", name, path, err.Error())
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("cannot read %s file %s: %s", name, path, err.Error())
+	}
+	return value, nil
+}
+
+// Credentials returns the user and password to use, it fails while a
+// credentials file was never read
+func (auth *Auth) Credentials() (string, string, error) {
+	username := auth.Username
+	password := auth.Password
+	if auth.UsernameFile != "" {
+		value, err := credential("user", auth.UsernameFile)
+		if err != nil {
+			return "", "", err
+		}
+		username = value
+	}
+	if auth.PasswordFile != "" {
+		value, err := credential("password", auth.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		password = value
+	}
+	return username, password, nil
+}
+
+func setAuth(request *http.Request, serverAuth *Auth) error {
+	username, password, err := serverAuth.Credentials()
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(username, password)
+	return nil
 }
 
 // ToMillis Convers a duration string to int64
@@ -31,12 +189,16 @@ func ToMillis(t string) int64 {
 }
 
 // GetAPI generic HTTP caller for GET operations
-func GetAPI(url string, serverAuth *Auth) []byte {
+func GetAPI(ctx context.Context, url string, serverAuth *Auth) []byte {
 	request, _ := http.NewRequest("GET", url, nil)
-	request.SetBasicAuth(serverAuth.Username, serverAuth.Password)
-	res, err := client.Do(request)
+	request = request.WithContext(ctx)
+	// The credentials failure is already logged
+	if err := setAuth(request, serverAuth); err != nil {
+		return []byte{}
+	}
+	res, err := httpClient().Do(request)
 	if err != nil {
-		fmt.Printf("Failed to scrap server %s", err.Error())
+		log.Printf("Failed to scrap server %s", err.Error())
 		return []byte{}
 	}
 	defer res.Body.Close()
@@ -46,3 +208,76 @@ func GetAPI(url string, serverAuth *Auth) []byte {
 	}
 	return []byte{}
 }
+
+// TryGetAPI generic HTTP caller for GET operations reporting why it failed
+func TryGetAPI(ctx context.Context, url string, serverAuth *Auth) ([]byte, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	request = request.WithContext(ctx)
+	if err := setAuth(request, serverAuth); err != nil {
+		return []byte{}, err
+	}
+	res, err := httpClient().Do(request)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer res.Body.Close()
+	response, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+	if res.StatusCode != 200 {
+		return response, fmt.Errorf("%s returned %d: %s", url, res.StatusCode, strings.TrimSpace(string(response)))
+	}
+	return response, nil
+}
+
+// PostAPI generic HTTP caller for POST operations
+func PostAPI(ctx context.Context, url string, serverAuth *Auth, contentType string, body []byte) ([]byte, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return []byte{}, err
+	}
+	request = request.WithContext(ctx)
+	if err := setAuth(request, serverAuth); err != nil {
+		return []byte{}, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	res, err := httpClient().Do(request)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer res.Body.Close()
+	response, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+	if res.StatusCode != 200 {
+		return response, fmt.Errorf("%s returned %d: %s", url, res.StatusCode, string(response))
+	}
+	return response, nil
+}
+
+// DeleteAPI generic HTTP caller for DELETE operations
+func DeleteAPI(ctx context.Context, url string, serverAuth *Auth) error {
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if err := setAuth(request, serverAuth); err != nil {
+		return err
+	}
+	res, err := httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		response, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s returned %d: %s", url, res.StatusCode, string(response))
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package cbapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowQueryNode(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(ClusterTimeout + time.Second):
+			w.Write([]byte(`{"requests":[]}`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ClusterTimeout+5*time.Second)
+	defer cancel()
+	response, err := TryGetAPI(ctx, node.URL+"/admin/active_requests", &Auth{})
+	if err != nil {
+		t.Fatalf("Expected the node to be waited for until the context is done, found %s", err.Error())
+	}
+	if string(response) != `{"requests":[]}` {
+		t.Errorf("Unexpected response %s", string(response))
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = TryGetAPI(ctx, node.URL+"/admin/active_requests", &Auth{}); err == nil {
+		t.Errorf("Expected the request to be aborted when the context is done")
+	}
+}
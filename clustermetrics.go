@@ -0,0 +1,240 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Values reported by /pools/default, every known value is exported so the
+// current one is 1 and the rest 0
+var nodeStatuses = []string{"healthy", "unhealthy", "warmup"}
+var nodeMemberships = []string{"active", "inactiveAdded", "inactiveFailed"}
+var nodeRecoveryTypes = []string{"none", "delta", "full"}
+var rebalanceOutcomes = []string{"success", "failed"}
+
+// Node health
+var nodeStatus = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_status",
+		Help: "Couchbase node status reported by the cluster manager",
+	},
+	[]string{"cluster", "node", "server_group", "status"},
+)
+
+var nodeMembership = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_membership",
+		Help: "Couchbase node cluster membership",
+	},
+	[]string{"cluster", "node", "server_group", "membership"},
+)
+
+var nodeRecoveryType = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_recovery_type",
+		Help: "Couchbase node recovery type after a failover",
+	},
+	[]string{"cluster", "node", "server_group", "recovery_type"},
+)
+
+var nodeInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_info",
+		Help: "Couchbase node version, edition and services, always 1",
+	},
+	[]string{"cluster", "node", "server_group", "version", "edition", "services"},
+)
+
+// Node resources
+var nodeCPUUtilization = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_cpu_utilization",
+		Help: "Couchbase node CPU utilization rate (percent)",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeCPUCount = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_cpu_count",
+		Help: "Couchbase node number of CPUs",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeMemoryTotal = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_memory_total_bytes",
+		Help: "Couchbase node total memory in bytes",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeMemoryFree = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_memory_free_bytes",
+		Help: "Couchbase node free memory in bytes",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeSwapTotal = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_swap_total_bytes",
+		Help: "Couchbase node total swap in bytes",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeSwapUsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_swap_used_bytes",
+		Help: "Couchbase node used swap in bytes",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+var nodeUptime = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_node_uptime_seconds",
+		Help: "Couchbase node uptime in seconds",
+	},
+	[]string{"cluster", "node", "server_group"},
+)
+
+// Cluster tasks
+var rebalanceRunning = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_rebalance_running",
+		Help: "Couchbase rebalance in progress (1) or not (0)",
+	},
+	[]string{"cluster"},
+)
+
+var rebalanceProgress = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_rebalance_progress",
+		Help: "Couchbase running rebalance progress (percent)",
+	},
+	[]string{"cluster"},
+)
+
+var rebalanceLastOutcome = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_rebalance_last_outcome",
+		Help: "Couchbase last rebalance outcome (success or failed)",
+	},
+	[]string{"cluster", "outcome"},
+)
+
+// Auto-failover
+var autoFailoverEnabled = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_autofailover_enabled",
+		Help: "Couchbase auto-failover enabled (1) or disabled (0)",
+	},
+	[]string{"cluster"},
+)
+
+var autoFailoverTimeout = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_autofailover_timeout_seconds",
+		Help: "Couchbase auto-failover timeout",
+	},
+	[]string{"cluster"},
+)
+
+var autoFailoverCount = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_autofailover_count",
+		Help: "Couchbase nodes automatically failed over since the count was last reset",
+	},
+	[]string{"cluster"},
+)
+
+var autoFailoverMaxCount = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_autofailover_max_count",
+		Help: "Couchbase maximum number of automatic failovers before a reset is required",
+	},
+	[]string{"cluster"},
+)
+
+// Buckets
+var bucketInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_info",
+		Help: "Couchbase bucket configuration, always 1",
+	},
+	[]string{"cluster", "bucket", "type", "storage_backend", "eviction_policy", "durability"},
+)
+
+var bucketRAMQuota = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_ram_quota_bytes",
+		Help: "Couchbase bucket RAM quota in bytes",
+	},
+	[]string{"cluster", "bucket"},
+)
+
+var bucketMemoryUsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_memory_used_bytes",
+		Help: "Couchbase bucket memory used in bytes",
+	},
+	[]string{"cluster", "bucket"},
+)
+
+var bucketItems = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_items",
+		Help: "Couchbase bucket number of items",
+	},
+	[]string{"cluster", "bucket"},
+)
+
+var bucketDiskUsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_disk_used_bytes",
+		Help: "Couchbase bucket disk used in bytes",
+	},
+	[]string{"cluster", "bucket"},
+)
+
+var bucketDataUsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cb_bucket_data_used_bytes",
+		Help: "Couchbase bucket data size on disk in bytes",
+	},
+	[]string{"cluster", "bucket"},
+)
+
+func initClusterMetrics() {
+	registerMetrics(
+		nodeStatus,
+		nodeMembership,
+		nodeRecoveryType,
+		nodeInfo,
+		// Node resources
+		nodeCPUUtilization,
+		nodeCPUCount,
+		nodeMemoryTotal,
+		nodeMemoryFree,
+		nodeSwapTotal,
+		nodeSwapUsed,
+		nodeUptime,
+		// Cluster tasks
+		rebalanceRunning,
+		rebalanceProgress,
+		rebalanceLastOutcome,
+		// Auto-failover
+		autoFailoverEnabled,
+		autoFailoverTimeout,
+		autoFailoverCount,
+		autoFailoverMaxCount,
+		// Buckets
+		bucketInfo,
+		bucketRAMQuota,
+		bucketMemoryUsed,
+		bucketItems,
+		bucketDiskUsed,
+		bucketDataUsed,
+	)
+}
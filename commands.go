@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/elfido/n1qlExporter/datamonitor"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// commands Diagnostics run instead of the exporter, they use the configured
+// clusters and exit. Standalone commands do not read the configuration.
+var commands = map[string]struct {
+	description string
+	run         func(definitions []configuration) int
+	standalone  bool
+}{
+	"discover": {"print the nodes, version and buckets discovered for every configured cluster", discoverCommand, false},
+	"check":    {"call every query service endpoint of every query node and report timing and errors", checkCommand, false},
+	"once":     {"collect the metrics once and print them in the Prometheus text format", onceCommand, false},
+	"schema":   {"print the JSON Schema of the configuration file", schemaCommand, true},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nWithout a command the exporter starts serving metrics.\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a diagnostics command and returns the exit code
+func runCommand(name string) int {
+	command, found := commands[name]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+		usage()
+		return 2
+	}
+	if command.standalone {
+		return command.run(nil)
+	}
+	if problems := validateConfiguration(); len(problems) > 0 {
+		fmt.Printf("Invalid configuration:\n%s\n", problems.Error())
+		return 1
+	}
+	definitions, err := getConfigurationDefs()
+	if err != nil {
+		fmt.Printf("Error reading configuration file: %s\n", err.Error())
+		return 1
+	}
+	if err := cbapi.SetTLSConfig(getTLSConfig()); err != nil {
+		fmt.Printf("Invalid TLS configuration: %s\n", err.Error())
+		return 1
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].clusterName < definitions[j].clusterName
+	})
+	return command.run(definitions)
+}
+
+func clusterURL(definition configuration) string {
+	protocol := "http"
+	if definition.useHTTPS {
+		protocol = "https"
+	}
+	return protocol + "://" + definition.hosts[0]
+}
+
+// discoverCommand prints the cluster map of every cluster
+func discoverCommand(definitions []configuration) int {
+	exitCode := 0
+	for _, definition := range definitions {
+		clusterName := definition.name
+		clusterMap, err := discoverCluster(context.Background(), clusterURL(definition), definition.auth)
+		if err != nil {
+			fmt.Printf("%s: discovery through %s failed: %s\n", clusterName, definition.hosts[0], err.Error())
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s (%s)\n", clusterName, clusterMap.Name)
+		fmt.Printf("  version:      %s\n", clusterMap.Version)
+		fmt.Printf("  nodes:        %d\n", clusterMap.TotalNodes)
+		fmt.Printf("  query nodes:  %s\n", strings.Join(clusterMap.QueryNodes, ", "))
+		fmt.Printf("  index nodes:  %s\n", strings.Join(clusterMap.IndexNodes, ", "))
+		fmt.Printf("  data nodes:   %s\n", strings.Join(clusterMap.DataNodes, ", "))
+		fmt.Printf("  buckets:\n")
+		for _, bucket := range clusterMap.BucketInfo {
+			fmt.Printf("    %s (%s, %s, %s eviction)\n", bucket.Name, bucket.Type, bucket.StorageBackend, bucket.EvictionPolicy)
+		}
+	}
+	return exitCode
+}
+
+// queryEndpoints Query service endpoints used by the exporter
+var queryEndpoints = []struct {
+	name string
+	path string
+}{
+	{"vitals", "/admin/vitals"},
+	{"active", "/admin/active_requests"},
+	{"completed", "/admin/completed_requests"},
+	{"prepareds", "/admin/prepareds"},
+	{"settings", "/admin/settings"},
+}
+
+// checkEndpoint calls an endpoint and prints how long it took or why it failed
+func checkEndpoint(name string, url string, auth *cbapi.Auth, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	response, err := cbapi.TryGetAPI(ctx, url, auth)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err == nil && !json.Valid(response) {
+		err = fmt.Errorf("%s returned an invalid JSON response", url)
+	}
+	if err != nil {
+		fmt.Printf("    %-10s FAILED %8s  %s\n", name, elapsed, err.Error())
+		return false
+	}
+	fmt.Printf("    %-10s OK     %8s  %d bytes\n", name, elapsed, len(response))
+	return true
+}
+
+// checkCommand calls the cluster and query service endpoints of every node
+func checkCommand(definitions []configuration) int {
+	exitCode := 0
+	for _, definition := range definitions {
+		clusterName := definition.name
+		fmt.Printf("%s\n", clusterName)
+		server := clusterURL(definition)
+		fmt.Printf("  %s\n", definition.hosts[0])
+		if !checkEndpoint("pools", server+":8091/pools/default", &definition.auth, cbapi.ClusterTimeout) {
+			exitCode = 1
+			continue
+		}
+		clusterMap, err := datamonitor.GetClusterMap(context.Background(), server, definition.auth)
+		if err != nil {
+			fmt.Printf("  discovery failed: %s\n", err.Error())
+			exitCode = 1
+			continue
+		}
+		if len(clusterMap.QueryNodes) == 0 {
+			fmt.Printf("  no query nodes found\n")
+			exitCode = 1
+		}
+		protocol := "http"
+		if definition.useHTTPS {
+			protocol = "https"
+		}
+		for _, node := range clusterMap.QueryNodes {
+			fmt.Printf("  %s\n", node)
+			for _, endpoint := range queryEndpoints {
+				if !checkEndpoint(endpoint.name, protocol+"://"+node+":8093"+endpoint.path, &definition.auth, definition.scrape.nodeTimeout(definition.scrape.interval)) {
+					exitCode = 1
+				}
+			}
+		}
+	}
+	return exitCode
+}
+
+// onceCommand collects every cluster once and prints the metrics. Queries are
+// never cancelled and the completed settings are not applied.
+func onceCommand(definitions []configuration) int {
+	initHistogramMetrics(getHistogramSettings())
+	if *legacyActiveMetrics {
+		initLegacyActiveMetrics()
+	}
+	if *legacyHistogramMetrics {
+		initLegacyHistogramMetrics()
+	}
+	// The monitors log their progress to stderr, only the metrics go to stdout
+	exitCode := 0
+	for _, definition := range definitions {
+		definition.cancel = nil
+		definition.completed = nil
+		monitor, err := newClusterMonitor(context.Background(), definition)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot discover cluster %s: %s\n", definition.clusterName, err.Error())
+			exitCode = 1
+			continue
+		}
+		monitor.execute(context.Background())
+	}
+	labels := make(map[string]clusterLabels)
+	for _, definition := range definitions {
+		labels[definition.name] = newClusterLabels(definition.labels, definition.relabel)
+	}
+	clusterRelabeler.set(labels)
+	families, err := clusterRelabeler.Gather()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error gathering metrics: %s\n", err.Error())
+		return 1
+	}
+	if err := writeMetrics(os.Stdout, families); err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing metrics: %s\n", err.Error())
+		return 1
+	}
+	return exitCode
+}
+
+// writeMetrics writes the metric families in the Prometheus text format
+func writeMetrics(out io.Writer, families []*dto.MetricFamily) error {
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(out, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaCommand prints the JSON Schema of the configuration file
+func schemaCommand(definitions []configuration) int {
+	schema, err := configurationSchema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating the schema: %s\n", err.Error())
+		return 1
+	}
+	os.Stdout.Write(schema)
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "n1qlexporter")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile = filepath.Join(dir, "settings.json")
+	defer func() {
+		configFile = ""
+		viper.Reset()
+	}()
+	ioutil.WriteFile(configFile, []byte(`{"clusters": {"c1": "host1:8091"}}`), 0600)
+	// The commands print to stdout and the usage to stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer devNull.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = devNull, devNull
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	}()
+	for _, command := range []struct {
+		name     string
+		exitCode int
+	}{
+		{"unknown", 2},
+		{"discover", 1}, // Invalid configuration
+		{"schema", 0},   // Standalone, doesn't read the configuration
+	} {
+		if exitCode := runCommand(command.name); exitCode != command.exitCode {
+			t.Errorf("%s: expected exit code %d, found %d", command.name, command.exitCode, exitCode)
+		}
+	}
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Write([]byte(`{"status": "ok"}`))
+		case "/text":
+			w.Write([]byte("ok"))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer node.Close()
+	for _, endpoint := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/json", true},
+		{"/text", false},
+		{"/missing", false},
+	} {
+		if ok := checkEndpoint(endpoint.path, node.URL+endpoint.path, &cbapi.Auth{}, cbapi.ClusterTimeout); ok != endpoint.ok {
+			t.Errorf("%s: expected %v, found %v", endpoint.path, endpoint.ok, ok)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "once_test", Help: "Once test"})
+	gauge.Set(1)
+	registry.MustRegister(gauge)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	var out bytes.Buffer
+	if err := writeMetrics(&out, families); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	expected := "# HELP once_test Once test\n# TYPE once_test gauge\nonce_test 1\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, found %q", expected, out.String())
+	}
+}
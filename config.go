@@ -1,49 +1,1057 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
 type configuration struct {
-	clusterName string
-	hosts       []string
-	useHTTPS    bool
-	auth        cbapi.Auth
+	clusterName      string
+	name             string // Value of the cluster label
+	labels           map[string]string
+	relabel          []relabelRule
+	hosts            []string
+	useHTTPS         bool
+	auth             cbapi.Auth
+	preparedTop      int
+	completed        *n1qlmonitor.CompletedSettings
+	adaptiveInterval bool // Shorten the scrape interval when the completed requests buffer overflows
+	longRunning      []time.Duration
+	cancel           *n1qlmonitor.CancelPolicy
+	quantiles        n1qlmonitor.QuantileSettings
+	scrape           scrapeSettings
 }
 
-func getConfigurationDefs() []configuration {
-	viper.SetConfigType("json")
+// credentials Couchbase user and password, the files take precedence and are
+// read again when they change so credentials can be rotated
+type credentials struct {
+	HTTPUser         string `json:"httpuser"`
+	HTTPPassword     string `json:"httppassword"`
+	HTTPUserFile     string `json:"httpuserfile"`
+	HTTPPasswordFile string `json:"httppasswordfile"`
+}
+
+// auth overrides the user and password of the defaults when they are set
+func (c credentials) auth(defaults cbapi.Auth) cbapi.Auth {
+	auth := defaults
+	if c.HTTPUser != "" || c.HTTPUserFile != "" {
+		auth.Username = c.HTTPUser
+		auth.UsernameFile = c.HTTPUserFile
+	}
+	if c.HTTPPassword != "" || c.HTTPPasswordFile != "" {
+		auth.Password = c.HTTPPassword
+		auth.PasswordFile = c.HTTPPasswordFile
+	}
+	return auth
+}
+
+// globalAuth reads the credentials used by every cluster unless overridden
+func globalAuth() cbapi.Auth {
+	return credentials{
+		HTTPUser:         viper.GetString("httpuser"),
+		HTTPPassword:     viper.GetString("httppassword"),
+		HTTPUserFile:     viper.GetString("httpuserfile"),
+		HTTPPasswordFile: viper.GetString("httppasswordfile"),
+	}.auth(cbapi.Auth{})
+}
+
+// splitHosts splits a comma separated list of hosts
+func splitHosts(hosts string) []string {
+	split := strings.Split(hosts, ",")
+	for ndx := range split {
+		split[ndx] = strings.TrimSpace(split[ndx])
+	}
+	return split
+}
+
+// clusterOptions Cluster definition when a cluster is configured as an object
+// instead of a comma separated list of hosts
+type clusterOptions struct {
+	credentials
+	Hosts            string                         `json:"hosts" schema:"required"`
+	Completed        *n1qlmonitor.CompletedSettings `json:"completed"`
+	AdaptiveInterval bool                           `json:"adaptiveinterval"`
+	Cancel           *n1qlmonitor.CancelPolicy      `json:"cancel"`
+	Scrape           *scrapeOptions                 `json:"scrape"`
+	Name             string                         `json:"name"` // Cluster label, the upper cased cluster key by default
+	Labels           map[string]string              `json:"labels"`
+	Relabel          []relabelRule                  `json:"relabel"`
+}
+
+// scrapeSettings Schedule of the scrapes of a cluster
+type scrapeSettings struct {
+	interval    time.Duration
+	timeout     time.Duration // 0 uses the interval
+	concurrency int           // Query nodes scraped at once, 0 scrapes every node at once
+	jitter      float64       // Fraction of the interval the scrapes are randomly moved by
+}
+
+var defaultScrapeSettings = scrapeSettings{
+	interval: scrapeInterval,
+	jitter:   0.1,
+}
+
+// nodeTimeout returns how long the query nodes are waited for, never longer
+// than the interval
+func (s scrapeSettings) nodeTimeout(interval time.Duration) time.Duration {
+	if s.timeout == 0 || s.timeout > interval {
+		return interval
+	}
+	return s.timeout
+}
+
+// scrapeOptions Scrape schedule as configured at the top level or per
+// cluster, the values not set are inherited
+type scrapeOptions struct {
+	Interval    string   `json:"interval"`
+	Timeout     string   `json:"timeout"`
+	Concurrency *int     `json:"concurrency"`
+	Jitter      *float64 `json:"jitter"`
+}
+
+// apply overrides the settings with the options that are set, invalid values
+// are reported by the validation and ignored
+func (o *scrapeOptions) apply(settings scrapeSettings) scrapeSettings {
+	if o == nil {
+		return settings
+	}
+	if interval, err := time.ParseDuration(o.Interval); err == nil && interval > 0 {
+		settings.interval = interval
+	}
+	if timeout, err := time.ParseDuration(o.Timeout); err == nil && timeout > 0 {
+		settings.timeout = timeout
+	}
+	if o.Concurrency != nil && *o.Concurrency >= 0 {
+		settings.concurrency = *o.Concurrency
+	}
+	if o.Jitter != nil && *o.Jitter >= 0 && *o.Jitter < 1 {
+		settings.jitter = *o.Jitter
+	}
+	return settings
+}
+
+// getScrapeSettings reads the scrape schedule inherited by every cluster
+func getScrapeSettings() scrapeSettings {
+	value := viper.GetStringMap("scrape")
+	if len(value) == 0 {
+		return defaultScrapeSettings
+	}
+	var options scrapeOptions
+	if err := decodeObject(value, &options); err != nil {
+		log.Printf("Invalid scrape configuration, using the defaults: %s\n", err.Error())
+		return defaultScrapeSettings
+	}
+	return options.apply(defaultScrapeSettings)
+}
+
+// quantileOptions Completed requests quantiles, objectives map a quantile to
+// its allowed error and an empty map disables them
+type quantileOptions struct {
+	Objectives map[string]float64 `json:"objectives"`
+	MaxAge     string             `json:"maxage"`
+	AgeBuckets int                `json:"agebuckets"`
+}
+
+var defaultObjectives = map[float64]float64{0.5: 0.05, 0.95: 0.005, 0.99: 0.001}
+
+// getQuantileSettings reads the quantiles settings, p50, p95 and p99 over 10
+// minutes by default
+func getQuantileSettings() n1qlmonitor.QuantileSettings {
+	settings := n1qlmonitor.QuantileSettings{
+		Objectives: defaultObjectives,
+		MaxAge:     10 * time.Minute,
+		AgeBuckets: 5,
+	}
+	value := viper.GetStringMap("quantiles")
+	if len(value) == 0 {
+		return settings
+	}
+	var options quantileOptions
+	if err := decodeObject(value, &options); err != nil {
+		log.Printf("Invalid quantiles configuration, using the defaults: %s\n", err.Error())
+		return settings
+	}
+	if options.Objectives != nil {
+		settings.Objectives = make(map[float64]float64)
+		for q, allowedError := range options.Objectives {
+			quantile, err := strconv.ParseFloat(q, 64)
+			if err != nil || quantile <= 0 || quantile >= 1 {
+				log.Printf("Invalid quantile %s, it must be between 0 and 1\n", q)
+				continue
+			}
+			settings.Objectives[quantile] = allowedError
+		}
+	}
+	if options.MaxAge != "" {
+		maxAge, err := time.ParseDuration(options.MaxAge)
+		if err != nil {
+			log.Printf("Invalid quantiles maxage %s: %s\n", options.MaxAge, err.Error())
+		} else {
+			settings.MaxAge = maxAge
+		}
+	}
+	if options.AgeBuckets > 0 {
+		settings.AgeBuckets = options.AgeBuckets
+	}
+	return settings
+}
+
+// normalizeValue converts the objects read from YAML files, keyed by
+// interface{}, to objects keyed by string
+func normalizeValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			object[fmt.Sprintf("%v", key)] = normalizeValue(item)
+		}
+		return object
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			object[key] = normalizeValue(item)
+		}
+		return object
+	case []interface{}:
+		list := make([]interface{}, len(typed))
+		for ndx, item := range typed {
+			list[ndx] = normalizeValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+// decodeObject maps an object from the configuration to its struct
+func decodeObject(value map[string]interface{}, target interface{}) error {
+	return decodeValue(value, target)
+}
+
+// decodeValue maps any value from the configuration to its Go type
+func decodeValue(value interface{}, target interface{}) error {
+	encoded, err := json.Marshal(normalizeValue(value))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, target)
+}
+
+// mergeLabels returns the static labels of a cluster, its own labels take
+// precedence over the global ones
+func mergeLabels(global map[string]string, cluster map[string]string) map[string]string {
+	if len(cluster) == 0 {
+		return global
+	}
+	merged := make(map[string]string, len(global)+len(cluster))
+	for name, value := range global {
+		merged[name] = value
+	}
+	for name, value := range cluster {
+		merged[name] = value
+	}
+	return merged
+}
+
+// getRelabelRules reads the relabeling rules applied to every cluster
+func getRelabelRules() []relabelRule {
+	value := viper.Get("relabel")
+	if value == nil {
+		return nil
+	}
+	var rules []relabelRule
+	if err := decodeValue(value, &rules); err != nil {
+		log.Printf("Invalid relabel configuration: %s\n", err.Error())
+		return nil
+	}
+	return rules
+}
+
+// decodeClusterOptions maps a cluster object from the configuration to its options
+func decodeClusterOptions(value map[string]interface{}) (clusterOptions, error) {
+	var options clusterOptions
+	err := decodeObject(value, &options)
+	return options, err
+}
+
+// getTLSConfig reads the certificates used to connect to the clusters
+func getTLSConfig() cbapi.TLSConfig {
+	var tlsConfig cbapi.TLSConfig
+	value := viper.GetStringMap("tls")
+	if len(value) > 0 {
+		if err := decodeObject(value, &tlsConfig); err != nil {
+			log.Printf("Invalid tls configuration: %s\n", err.Error())
+		}
+	}
+	return tlsConfig
+}
+
+// configFile Configuration file, settings.json in the working directory when empty
+var configFile string
+
+// configTypes Configuration file formats per extension
+var configTypes = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+}
+
+// readConfiguration reads and parses the configuration file once, the
+// settings are then taken from viper. It returns the content of the file.
+func readConfiguration() ([]byte, error) {
 	viper.AutomaticEnv()
-	viper.SetConfigName("settings")
-	viper.AddConfigPath(".")
+	file := configFile
+	if file == "" {
+		file = "settings.json"
+	}
+	configType, found := configTypes[strings.ToLower(filepath.Ext(file))]
+	if !found {
+		return nil, fmt.Errorf("unsupported configuration file %s, use a .json, .yaml, .yml or .toml file", file)
+	}
+	viper.SetConfigType(configType)
+	viper.SetConfigFile(file)
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	err := viper.ReadInConfig()
+	viper.SetDefault("preparedtop", 10)
+	viper.SetDefault("longrunningthresholds", []string{"1m", "5m", "30m"})
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Printf("Error reading configuration file: %s\n", err.Error())
-		return []configuration{}
+		return nil, err
+	}
+	if !envReference.Match(data) {
+		return data, viper.ReadConfig(bytes.NewReader(data))
+	}
+	// The references are expanded in the parsed string values, so the values
+	// need no escaping whatever the format of the file
+	parsed := viper.New()
+	parsed.SetConfigType(configType)
+	if err := parsed.ReadConfig(bytes.NewReader(data)); err != nil {
+		return data, err
+	}
+	settings := make(map[string]interface{})
+	for _, key := range parsed.AllKeys() {
+		// Nested keys can contain dots, only the top level keys are split
+		name := strings.SplitN(key, ".", 2)[0]
+		settings[name] = parsed.Get(name)
 	}
-	httpuser := viper.GetString("httpuser")
-	httppassword := viper.GetString("httppassword")
+	missing := []string{}
+	expanded, err := json.Marshal(expandEnvReferences(settings, &missing))
+	if err != nil {
+		return data, err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return data, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	viper.SetConfigType("json")
+	return data, viper.ReadConfig(bytes.NewReader(expanded))
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvReferences replaces the ${VAR} references of the string values of
+// a parsed configuration by the value of the environment variable, the
+// variables not set are added to missing
+func expandEnvReferences(value interface{}, missing *[]string) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(typed, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			variable, found := os.LookupEnv(name)
+			if !found {
+				*missing = append(*missing, name)
+				return reference
+			}
+			return variable
+		})
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			expanded[key] = expandEnvReferences(item, missing)
+		}
+		return expanded
+	case map[interface{}]interface{}:
+		expanded := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			expanded[fmt.Sprint(key)] = expandEnvReferences(item, missing)
+		}
+		return expanded
+	case []interface{}:
+		expanded := make([]interface{}, len(typed))
+		for ndx, item := range typed {
+			expanded[ndx] = expandEnvReferences(item, missing)
+		}
+		return expanded
+	case []map[string]interface{}:
+		expanded := make([]interface{}, len(typed))
+		for ndx, item := range typed {
+			expanded[ndx] = expandEnvReferences(item, missing)
+		}
+		return expanded
+	}
+	return value
+}
+
+// getHistogramSettings reads the histogram buckets settings
+func getHistogramSettings() histogramSettings {
+	if _, err := readConfiguration(); err != nil {
+		log.Printf("Error reading configuration file: %s\n", err.Error())
+		return histogramSettings{}
+	}
+	return configuredHistogramSettings()
+}
+
+// configuredHistogramSettings returns the histogram buckets settings of the
+// configuration last read
+func configuredHistogramSettings() histogramSettings {
+	var settings histogramSettings
+	histograms := viper.GetStringMap("histograms")
+	if len(histograms) == 0 {
+		return settings
+	}
+	if err := decodeObject(histograms, &settings); err != nil {
+		log.Printf("Invalid histograms configuration, using the default buckets: %s\n", err.Error())
+		return histogramSettings{}
+	}
+	return settings
+}
+
+// probeModule Credentials used to probe the targets of the /probe endpoint
+// and the targets they may be sent to
+type probeModule struct {
+	credentials
+	UseHTTPS bool   `json:"usehttps"`
+	Targets  string `json:"targets" schema:"required"` // Regex the whole target must match
+	targets  *regexp.Regexp
+}
+
+// compileTargets compiles the targets regex of a module
+func (m *probeModule) compileTargets() error {
+	if m.Targets == "" {
+		return fmt.Errorf("required")
+	}
+	targets, err := regexp.Compile("^(?:" + m.Targets + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %s", m.Targets, err.Error())
+	}
+	m.targets = targets
+	return nil
+}
+
+// allows tells whether the credentials of the module may be sent to target
+func (m probeModule) allows(target string) bool {
+	return m.targets != nil && m.targets.MatchString(target)
+}
+
+// getProbeModules reads the probe modules, modules without valid targets are
+// reported by the validation and ignored
+func getProbeModules() map[string]probeModule {
+	modules := make(map[string]probeModule)
+	for name, value := range viper.GetStringMap("modules") {
+		options, ok := normalizeValue(value).(map[string]interface{})
+		if !ok {
+			log.Printf("Invalid configuration for probe module %s\n", name)
+			continue
+		}
+		var module probeModule
+		if err := decodeObject(options, &module); err != nil {
+			log.Printf("Invalid configuration for probe module %s: %s\n", name, err.Error())
+			continue
+		}
+		if err := module.compileTargets(); err != nil {
+			log.Printf("Invalid targets for probe module %s: %s\n", name, err.Error())
+			continue
+		}
+		modules[name] = module
+	}
+	return modules
+}
+
+func getConfigurationDefs() ([]configuration, error) {
+	if _, err := readConfiguration(); err != nil {
+		return []configuration{}, err
+	}
+	return configurationDefs(), nil
+}
+
+// configurationDefs returns the clusters of the configuration last read
+func configurationDefs() []configuration {
+	auth := globalAuth()
 	useHTTPS := viper.GetBool("usehttps")
-	clusters := viper.GetStringMapString("clusters")
-	cfg := make([]configuration, len(clusters), len(clusters))
-	ndx := 0
-	for cluster := range clusters {
-		hosts := strings.Split(clusters[cluster], ",")
-		cfg[ndx] = configuration{
+	preparedTop := viper.GetInt("preparedtop")
+	longRunning := []time.Duration{}
+	for _, threshold := range viper.GetStringSlice("longrunningthresholds") {
+		duration, err := time.ParseDuration(threshold)
+		if err != nil {
+			log.Printf("Invalid long running threshold %s: %s\n", threshold, err.Error())
+			continue
+		}
+		longRunning = append(longRunning, duration)
+	}
+	quantiles := getQuantileSettings()
+	scrape := getScrapeSettings()
+	labels := viper.GetStringMapString("labels")
+	if len(labels) == 0 {
+		labels = nil
+	}
+	relabel := getRelabelRules()
+	clusters := viper.GetStringMap("clusters")
+	cfg := make([]configuration, 0, len(clusters))
+	for cluster, value := range clusters {
+		definition := configuration{
 			clusterName: cluster,
-			auth: cbapi.Auth{
-				Username: httpuser,
-				Password: httppassword,
-			},
-			useHTTPS: useHTTPS,
-			hosts:    hosts,
+			name:        strings.ToUpper(cluster),
+			labels:      labels,
+			relabel:     relabel,
+			auth:        auth,
+			useHTTPS:    useHTTPS,
+			preparedTop: preparedTop,
+			longRunning: longRunning,
+			quantiles:   quantiles,
+			scrape:      scrape,
 		}
-		ndx++
+		switch clusterValue := normalizeValue(value).(type) {
+		case string:
+			definition.hosts = splitHosts(clusterValue)
+		case map[string]interface{}:
+			options, err := decodeClusterOptions(clusterValue)
+			if err != nil {
+				log.Printf("Invalid configuration for cluster %s: %s\n", cluster, err.Error())
+				continue
+			}
+			definition.hosts = splitHosts(options.Hosts)
+			definition.auth = options.credentials.auth(auth)
+			definition.completed = options.Completed
+			definition.adaptiveInterval = options.AdaptiveInterval
+			definition.cancel = options.Cancel
+			definition.scrape = options.Scrape.apply(scrape)
+			if options.Name != "" {
+				definition.name = options.Name
+			}
+			definition.labels = mergeLabels(labels, options.Labels)
+			definition.relabel = append(append([]relabelRule{}, relabel...), options.Relabel...)
+			if len(definition.relabel) == 0 {
+				definition.relabel = nil
+			}
+		default:
+			log.Printf("Invalid configuration for cluster %s\n", cluster)
+			continue
+		}
+		cfg = append(cfg, definition)
 	}
 	return cfg
 }
+
+// configError Configuration problem with the file and key it was found in
+type configError struct {
+	file    string
+	key     string
+	message string
+}
+
+func (e configError) Error() string {
+	if e.key == "" {
+		return fmt.Sprintf("%s: %s", e.file, e.message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.file, e.key, e.message)
+}
+
+// configErrors Every problem found in a configuration, one per line
+type configErrors []error
+
+func (e configErrors) Error() string {
+	messages := make([]string, len(e))
+	for ndx, err := range e {
+		messages[ndx] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+var (
+	topLevelKeys  = []string{"httpuser", "httppassword", "httpuserfile", "httppasswordfile", "usehttps", "tls", "clusters", "preparedtop", "longrunningthresholds", "histograms", "quantiles", "modules", "scrape", "labels", "relabel"}
+	clusterKeys   = []string{"hosts", "httpuser", "httppassword", "httpuserfile", "httppasswordfile", "completed", "adaptiveinterval", "cancel", "scrape", "name", "labels", "relabel"}
+	completedKeys = []string{"threshold", "limit", "qualifiers"}
+	cancelKeys    = []string{"enabled", "dryrun", "rules"}
+	ruleKeys      = []string{"name", "maxelapsed", "fingerprint", "users", "statement", "primaryscan"}
+	tlsKeys       = []string{"cafile", "certfile", "keyfile", "insecureskipverify"}
+	histogramKeys = []string{"buckets"}
+	quantileKeys  = []string{"objectives", "maxage", "agebuckets"}
+	relabelKeys   = []string{"label", "action", "regex", "replacement"}
+	scrapeKeys    = []string{"interval", "timeout", "concurrency", "jitter"}
+	moduleKeys    = []string{"httpuser", "httppassword", "httpuserfile", "httppasswordfile", "usehttps", "targets"}
+)
+
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// configValidator collects the problems found in a configuration file
+type configValidator struct {
+	file     string
+	problems configErrors
+}
+
+func (v *configValidator) add(key string, format string, args ...interface{}) {
+	v.problems = append(v.problems, configError{file: v.file, key: key, message: fmt.Sprintf(format, args...)})
+}
+
+func joinKey(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// object reads an object, configured as such or as a JSON string in an
+// environment variable
+func (v *configValidator) object(key string, value interface{}) (map[string]interface{}, bool) {
+	object, err := cast.ToStringMapE(normalizeValue(value))
+	if err != nil {
+		v.add(key, "must be an object")
+		return nil, false
+	}
+	return object, true
+}
+
+// checkKeys reports the keys of an object that are not known
+func (v *configValidator) checkKeys(key string, object map[string]interface{}, known []string) {
+	unknown := []string{}
+	for name := range object {
+		found := false
+		for _, knownName := range known {
+			found = found || strings.EqualFold(name, knownName)
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		v.add(joinKey(key, name), "unknown key, expected one of %s", strings.Join(known, ", "))
+	}
+}
+
+func (v *configValidator) decode(key string, object map[string]interface{}, target interface{}) bool {
+	if err := decodeObject(object, target); err != nil {
+		v.add(key, "invalid value: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+func (v *configValidator) duration(key string, value string) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		v.add(key, "invalid duration %q", value)
+	} else if duration <= 0 {
+		v.add(key, "duration must be positive")
+	}
+}
+
+// checkHost validates a host as used to build the cluster URLs, the ports are
+// always 8091 and 8093
+func checkHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("empty host")
+	}
+	if strings.Contains(host, "://") {
+		return fmt.Errorf("host %q must not include the protocol, use usehttps", host)
+	}
+	if strings.ContainsAny(host, "/ \t") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("IPv6 address %q is not supported, use a host name", host)
+		}
+		return nil
+	}
+	if strings.Contains(host, ":") {
+		return fmt.Errorf("host %q must not include a port, the exporter uses 8091 and 8093", host)
+	}
+	if !hostNamePattern.MatchString(host) {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+	return nil
+}
+
+func (v *configValidator) checkFile(key string, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.add(key, "cannot read %s: %s", path, err.Error())
+	}
+}
+
+// checkCredentials reports secret files that cannot be read
+func (v *configValidator) checkCredentials(key string, c credentials) {
+	if c.HTTPUserFile != "" {
+		if _, err := cbapi.ReadSecret(c.HTTPUserFile); err != nil {
+			v.add(joinKey(key, "httpuserfile"), "%s", err.Error())
+		}
+	}
+	if c.HTTPPasswordFile != "" {
+		if _, err := cbapi.ReadSecret(c.HTTPPasswordFile); err != nil {
+			v.add(joinKey(key, "httppasswordfile"), "%s", err.Error())
+		}
+	}
+}
+
+// scrape checks a scrape object and returns the settings it results in
+func (v *configValidator) scrape(key string, value interface{}, inherited scrapeSettings) scrapeSettings {
+	object, ok := v.object(key, value)
+	if !ok {
+		return inherited
+	}
+	v.checkKeys(key, object, scrapeKeys)
+	var options scrapeOptions
+	if !v.decode(key, object, &options) {
+		return inherited
+	}
+	if options.Interval != "" {
+		v.duration(joinKey(key, "interval"), options.Interval)
+		if interval, err := time.ParseDuration(options.Interval); err == nil && interval > 0 && interval < minScrapeInterval {
+			v.add(joinKey(key, "interval"), "must be at least %s", minScrapeInterval)
+		}
+	}
+	if options.Timeout != "" {
+		v.duration(joinKey(key, "timeout"), options.Timeout)
+	}
+	if options.Concurrency != nil && *options.Concurrency < 0 {
+		v.add(joinKey(key, "concurrency"), "must not be negative")
+	}
+	if options.Jitter != nil && (*options.Jitter < 0 || *options.Jitter >= 1) {
+		v.add(joinKey(key, "jitter"), "must be between 0 and 1")
+	}
+	settings := options.apply(inherited)
+	if options.Timeout != "" && settings.timeout > settings.interval {
+		v.add(joinKey(key, "timeout"), "must not be longer than the interval %s", settings.interval)
+	}
+	return settings
+}
+
+// labels checks static labels
+func (v *configValidator) labels(key string, value interface{}) {
+	object, ok := v.object(key, value)
+	if !ok {
+		return
+	}
+	for name, labelValue := range object {
+		if err := checkLabelName(name); err != nil {
+			v.add(joinKey(key, name), "%s", err.Error())
+		}
+		if _, err := cast.ToStringE(labelValue); err != nil {
+			v.add(joinKey(key, name), "must be a string")
+		}
+	}
+}
+
+// relabel checks a list of relabeling rules
+func (v *configValidator) relabel(key string, value interface{}) {
+	rules, ok := normalizeValue(value).([]interface{})
+	if !ok {
+		v.add(key, "must be a list of rules")
+		return
+	}
+	for ndx, rule := range rules {
+		ruleKey := fmt.Sprintf("%s[%d]", key, ndx)
+		object, ok := v.object(ruleKey, rule)
+		if !ok {
+			continue
+		}
+		v.checkKeys(ruleKey, object, relabelKeys)
+		var options relabelRule
+		if !v.decode(ruleKey, object, &options) {
+			continue
+		}
+		if _, err := options.compile(); err != nil {
+			v.add(ruleKey, "%s", err.Error())
+		}
+	}
+}
+
+// validateCluster checks a cluster and returns its cluster label
+func (v *configValidator) validateCluster(key string, value interface{}, scrape scrapeSettings) string {
+	var hosts string
+	name := strings.ToUpper(key[strings.LastIndex(key, ".")+1:])
+	switch clusterValue := normalizeValue(value).(type) {
+	case string:
+		hosts = clusterValue
+	case map[string]interface{}:
+		v.checkKeys(key, clusterValue, clusterKeys)
+		var options clusterOptions
+		if !v.decode(key, clusterValue, &options) {
+			return name
+		}
+		hosts = options.Hosts
+		if options.Name != "" {
+			name = options.Name
+		}
+		v.checkCredentials(key, options.credentials)
+		if options.Hosts == "" {
+			v.add(joinKey(key, "hosts"), "required")
+			return name
+		}
+		if labels, found := clusterValue["labels"]; found {
+			v.labels(joinKey(key, "labels"), labels)
+		}
+		if relabel, found := clusterValue["relabel"]; found {
+			v.relabel(joinKey(key, "relabel"), relabel)
+		}
+		if completed, found := clusterValue["completed"]; found {
+			if object, ok := v.object(joinKey(key, "completed"), completed); ok {
+				v.checkKeys(joinKey(key, "completed"), object, completedKeys)
+			}
+		}
+		if options.Completed != nil {
+			if options.Completed.Threshold != nil && *options.Completed.Threshold < -1 {
+				v.add(joinKey(key, "completed.threshold"), "must be -1 (disabled), 0 (every request) or a number of milliseconds")
+			}
+			if options.Completed.Limit != nil && *options.Completed.Limit < 0 {
+				v.add(joinKey(key, "completed.limit"), "must not be negative")
+			}
+		}
+		if cancel, found := clusterValue["cancel"]; found {
+			if object, ok := v.object(joinKey(key, "cancel"), cancel); ok {
+				v.checkKeys(joinKey(key, "cancel"), object, cancelKeys)
+				rules, _ := object["rules"].([]interface{})
+				for ndx, rule := range rules {
+					ruleKey := fmt.Sprintf("%s.rules[%d]", joinKey(key, "cancel"), ndx)
+					if ruleObject, ok := v.object(ruleKey, rule); ok {
+						v.checkKeys(ruleKey, ruleObject, ruleKeys)
+					}
+				}
+			}
+		}
+		if options.Cancel != nil {
+			if err := options.Cancel.Validate(); err != nil {
+				v.add(joinKey(key, "cancel"), "%s", err.Error())
+			}
+		}
+		if value, found := clusterValue["scrape"]; found {
+			v.scrape(joinKey(key, "scrape"), value, scrape)
+		}
+	default:
+		v.add(key, "must be a comma separated list of hosts or an object")
+		return name
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if err := checkHost(strings.TrimSpace(host)); err != nil {
+			v.add(key, "%s", err.Error())
+		}
+	}
+	return name
+}
+
+// validateSettings checks the settings of a configuration file, with the keys
+// lowercased, and returns every problem found
+func validateSettings(file string, settings map[string]interface{}) configErrors {
+	v := &configValidator{file: file}
+	v.checkKeys("", settings, topLevelKeys)
+	if value, found := settings["usehttps"]; found {
+		if _, err := cast.ToBoolE(value); err != nil {
+			v.add("usehttps", "must be true or false")
+		}
+	}
+	if value, found := settings["preparedtop"]; found {
+		if top, err := cast.ToIntE(value); err != nil || top < 0 {
+			v.add("preparedtop", "must be a positive number")
+		}
+	}
+	if value, found := settings["longrunningthresholds"]; found {
+		thresholds, err := cast.ToStringSliceE(value)
+		if err != nil {
+			v.add("longrunningthresholds", "must be a list of durations")
+		}
+		for ndx, threshold := range thresholds {
+			v.duration(fmt.Sprintf("longrunningthresholds[%d]", ndx), threshold)
+		}
+	}
+	v.checkCredentials("", credentials{
+		HTTPUserFile:     cast.ToString(settings["httpuserfile"]),
+		HTTPPasswordFile: cast.ToString(settings["httppasswordfile"]),
+	})
+	if value, found := settings["tls"]; found {
+		if object, ok := v.object("tls", value); ok {
+			v.checkKeys("tls", object, tlsKeys)
+			var tlsConfig cbapi.TLSConfig
+			if v.decode("tls", object, &tlsConfig) {
+				v.checkFile("tls.cafile", tlsConfig.CAFile)
+				v.checkFile("tls.certfile", tlsConfig.CertFile)
+				v.checkFile("tls.keyfile", tlsConfig.KeyFile)
+				if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+					v.add("tls", "certfile and keyfile must be set together")
+				}
+			}
+		}
+	}
+	if value, found := settings["labels"]; found {
+		v.labels("labels", value)
+	}
+	if value, found := settings["relabel"]; found {
+		v.relabel("relabel", value)
+	}
+	scrape := defaultScrapeSettings
+	if value, found := settings["scrape"]; found {
+		scrape = v.scrape("scrape", value, scrape)
+	}
+	clusters, found := settings["clusters"]
+	if !found {
+		v.add("clusters", "required, no cluster would be monitored")
+	} else if object, ok := v.object("clusters", clusters); ok {
+		if len(object) == 0 {
+			v.add("clusters", "no cluster defined")
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		labels := make(map[string]string)
+		for _, name := range names {
+			key := joinKey("clusters", name)
+			label := v.validateCluster(key, object[name], scrape)
+			if other, found := labels[label]; found {
+				v.add(key, "cluster label %s is already used by %s", label, other)
+			}
+			labels[label] = key
+		}
+	}
+	if value, found := settings["histograms"]; found {
+		if object, ok := v.object("histograms", value); ok {
+			v.checkKeys("histograms", object, histogramKeys)
+			var histograms histogramSettings
+			if v.decode("histograms", object, &histograms) {
+				for name, buckets := range histograms.Buckets {
+					if err := validateBuckets(buckets); err != nil {
+						v.add(joinKey("histograms.buckets", name), "%s", err.Error())
+					}
+				}
+			}
+		}
+	}
+	if value, found := settings["quantiles"]; found {
+		if object, ok := v.object("quantiles", value); ok {
+			v.checkKeys("quantiles", object, quantileKeys)
+			var options quantileOptions
+			if v.decode("quantiles", object, &options) {
+				for q, allowedError := range options.Objectives {
+					quantile, err := strconv.ParseFloat(q, 64)
+					if err != nil || quantile <= 0 || quantile >= 1 {
+						v.add(joinKey("quantiles.objectives", q), "quantile must be between 0 and 1")
+					}
+					if allowedError <= 0 || allowedError >= 1 {
+						v.add(joinKey("quantiles.objectives", q), "allowed error must be between 0 and 1")
+					}
+				}
+				if options.MaxAge != "" {
+					v.duration("quantiles.maxage", options.MaxAge)
+				}
+				if options.AgeBuckets < 0 {
+					v.add("quantiles.agebuckets", "must be a positive number")
+				}
+			}
+		}
+	}
+	if value, found := settings["modules"]; found {
+		if object, ok := v.object("modules", value); ok {
+			for name, module := range object {
+				key := joinKey("modules", name)
+				if moduleObject, ok := v.object(key, module); ok {
+					v.checkKeys(key, moduleObject, moduleKeys)
+					var options probeModule
+					if v.decode(key, moduleObject, &options) {
+						v.checkCredentials(key, options.credentials)
+						if err := options.compileTargets(); err != nil {
+							v.add(joinKey(key, "targets"), "%s", err.Error())
+						}
+					}
+				}
+			}
+		}
+	}
+	return v.problems
+}
+
+// duplicateKeys walks a JSON document reporting keys defined more than once in
+// the same object, ignoring case since keys are case insensitive
+func duplicateKeys(decoder *json.Decoder, path string, duplicates *[]string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return nil
+	}
+	switch delim {
+	case '{':
+		seen := make(map[string]bool)
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+			if seen[strings.ToLower(key)] {
+				*duplicates = append(*duplicates, joinKey(path, key))
+			}
+			seen[strings.ToLower(key)] = true
+			if err := duplicateKeys(decoder, joinKey(path, key), duplicates); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for ndx := 0; decoder.More(); ndx++ {
+			if err := duplicateKeys(decoder, fmt.Sprintf("%s[%d]", path, ndx), duplicates); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+// validateConfiguration reads the configuration and returns every problem found
+func validateConfiguration() configErrors {
+	data, err := readConfiguration()
+	if err != nil {
+		file := configFile
+		if file == "" {
+			file = "settings.json"
+		}
+		return configErrors{configError{file: file, message: fmt.Sprintf("cannot read the configuration: %s", err.Error())}}
+	}
+	return validateConfigurationRead(data)
+}
+
+// validateConfigurationRead checks the configuration last read, data is the
+// content of its file
+func validateConfigurationRead(data []byte) configErrors {
+	file := viper.ConfigFileUsed()
+	problems := configErrors{}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		duplicates := []string{}
+		if err := duplicateKeys(json.NewDecoder(bytes.NewReader(data)), "", &duplicates); err != nil {
+			problems = append(problems, configError{file: file, message: fmt.Sprintf("invalid JSON: %s", err.Error())})
+		}
+		for _, key := range duplicates {
+			problems = append(problems, configError{file: file, key: key, message: "defined more than once (keys are case insensitive)"})
+		}
+	}
+	return append(problems, validateSettings(file, viper.AllSettings())...)
+}
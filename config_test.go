@@ -1,10 +1,202 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
 
 func TestReadConfigFromFile(t *testing.T) {
-	monitorDefinitions := getServers()
+	configFile = "testdata/settings.json"
+	defer func() {
+		configFile = ""
+		viper.Reset()
+	}()
+	monitorDefinitions, err := getConfigurationDefs()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
 	if len(monitorDefinitions) != 2 {
 		t.Errorf("Expected 2 monitor definitions, found %d", len(monitorDefinitions))
 	}
+	if problems := validateConfiguration(); len(problems) > 0 {
+		t.Errorf("Expected a valid configuration, found:\n%s", problems.Error())
+	}
+}
+
+func TestReadConfigFormats(t *testing.T) {
+	defer func() {
+		configFile = ""
+		viper.Reset()
+	}()
+	for _, file := range []string{"testdata/settings.yaml", "testdata/settings.toml"} {
+		viper.Reset()
+		configFile = file
+		monitorDefinitions, err := getConfigurationDefs()
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", file, err.Error())
+		}
+		if len(monitorDefinitions) != 2 {
+			t.Errorf("%s: expected 2 monitor definitions, found %d", file, len(monitorDefinitions))
+		}
+		if problems := validateConfiguration(); len(problems) > 0 {
+			t.Errorf("%s: expected a valid configuration, found:\n%s", file, problems.Error())
+		}
+	}
+	configFile = "testdata/settings.ini"
+	if _, err := readConfiguration(); err == nil {
+		t.Errorf("Expected an error for an unsupported configuration file")
+	}
+}
+
+// TestSchemaUpToDate checks settings.schema.json was regenerated after the
+// configuration types changed, run ./n1qlExporter schema > settings.schema.json
+func TestSchemaUpToDate(t *testing.T) {
+	schema, err := configurationSchema()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	published, err := ioutil.ReadFile("settings.schema.json")
+	if err != nil {
+		t.Fatalf("Cannot read the published schema: %s", err.Error())
+	}
+	if string(schema) != string(published) {
+		t.Errorf("settings.schema.json is out of date, regenerate it with the schema command")
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	var settings map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"usehttps": "maybe",
+		"longrunningthresholds": ["1m", "soon"],
+		"tls": { "cafile": "testdata/missing.pem" },
+		"clusters": {
+			"c1": "http://host1,host2:8091",
+			"c2": { "hosts": "host3", "cancel": { "enabled": true, "rules": [{ "name": "r" }] } },
+			"c3": { "completed": { "limit": 10 }, "other": 1 },
+			"c4": { "hosts": "host4", "scrape": { "interval": "20s", "timeout": "25s" } },
+			"c5": { "hosts": "host5", "name": "C4", "labels": { "node": "n" }, "relabel": [{ "label": "bucket" }] }
+		},
+		"scrape": { "interval": "1s", "jitter": 2 },
+		"histograms": { "buckets": { "n1ql_completed_time_execution_seconds": [1, 0.5] } },
+		"modules": { "m1": { "httpuser": "probe" }, "m2": { "targets": "cb[" } },
+		"extra": true
+	}`), &settings)
+	problems := validateSettings("settings.json", settings)
+	expected := []string{
+		"settings.json: extra: unknown key",
+		"settings.json: usehttps:",
+		"settings.json: longrunningthresholds[1]:",
+		"settings.json: tls.cafile:",
+		"settings.json: clusters.c1: host \"http://host1\" must not include the protocol",
+		"settings.json: clusters.c1: host \"host2:8091\" must not include a port",
+		"settings.json: clusters.c2.cancel: rule r has no maxelapsed",
+		"settings.json: clusters.c3.other: unknown key",
+		"settings.json: clusters.c3.hosts: required",
+		"settings.json: clusters.c4.scrape.timeout: must not be longer than the interval 20s",
+		"settings.json: clusters.c5: cluster label C4 is already used by clusters.c4",
+		"settings.json: clusters.c5.labels.node: label node is set by the exporter",
+		"settings.json: clusters.c5.relabel[0]: label must be one of node, query_type",
+		"settings.json: scrape.interval: must be at least",
+		"settings.json: scrape.jitter:",
+		"settings.json: histograms.buckets.n1ql_completed_time_execution_seconds:",
+		"settings.json: modules.m1.targets: required",
+		"settings.json: modules.m2.targets: invalid regex",
+	}
+	message := problems.Error()
+	for _, problem := range expected {
+		if !strings.Contains(message, problem) {
+			t.Errorf("Expected %q in the problems found:\n%s", problem, message)
+		}
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, found %d:\n%s", len(expected), len(problems), message)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	duplicates := []string{}
+	err := duplicateKeys(json.NewDecoder(strings.NewReader(`{"clusters": {"prod": "h1", "PROD": "h2"}, "modules": [{"a": 1, "a": 2}]}`)), "", &duplicates)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	if len(duplicates) != 2 || duplicates[0] != "clusters.PROD" || duplicates[1] != "modules[0].a" {
+		t.Errorf("Unexpected duplicates %v", duplicates)
+	}
+}
+
+func TestExpandEnvReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "n1qlexporter")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		configFile = ""
+		viper.Reset()
+	}()
+	secret := `p"a\s'$`
+	os.Setenv("N1QL_TEST_PASSWORD", secret)
+	defer os.Unsetenv("N1QL_TEST_PASSWORD")
+	for name, content := range map[string]string{
+		"settings.json": `{"httppassword": "${N1QL_TEST_PASSWORD}", "clusters": {"c1.example": {"hosts": "h1", "httpuser": "u-${N1QL_TEST_PASSWORD}"}}}`,
+		"settings.yaml": "httppassword: ${N1QL_TEST_PASSWORD}\nclusters:\n  c1.example:\n    hosts: h1\n    httpuser: 'u-${N1QL_TEST_PASSWORD}'\n",
+		"settings.toml": "httppassword = \"${N1QL_TEST_PASSWORD}\"\n[clusters.\"c1.example\"]\nhosts = \"h1\"\nhttpuser = 'u-${N1QL_TEST_PASSWORD}'\n",
+	} {
+		viper.Reset()
+		configFile = filepath.Join(dir, name)
+		ioutil.WriteFile(configFile, []byte(content), 0600)
+		if _, err := readConfiguration(); err != nil {
+			t.Errorf("%s: unexpected error %s", name, err.Error())
+			continue
+		}
+		if password := viper.GetString("httppassword"); password != secret {
+			t.Errorf("%s: unexpected password %q", name, password)
+		}
+		cluster := cast.ToStringMap(viper.GetStringMap("clusters")["c1.example"])
+		if user := cluster["httpuser"]; user != "u-"+secret {
+			t.Errorf("%s: unexpected cluster user %q", name, user)
+		}
+	}
+	viper.Reset()
+	configFile = filepath.Join(dir, "missing.json")
+	ioutil.WriteFile(configFile, []byte(`{"httpuser": "${N1QL_TEST_MISSING}"}`), 0600)
+	if _, err := readConfiguration(); err == nil {
+		t.Errorf("Expected an error for a missing environment variable")
+	}
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "n1qlexporter")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("first\n"), 0600)
+	global := credentials{HTTPUser: "global", HTTPPassword: "global"}.auth(cbapi.Auth{})
+	auth := credentials{HTTPPasswordFile: passwordFile}.auth(global)
+	if user, password, err := auth.Credentials(); err != nil || user != "global" || password != "first" {
+		t.Errorf("Unexpected credentials %s/%s", user, password)
+	}
+	ioutil.WriteFile(passwordFile, []byte("second-password\n"), 0600)
+	if _, password, _ := auth.Credentials(); password != "second-password" {
+		t.Errorf("Expected the rotated password, found %s", password)
+	}
+	os.Remove(passwordFile)
+	if _, password, err := auth.Credentials(); err != nil || password != "second-password" {
+		t.Errorf("Expected the last password to be kept, found %s", password)
+	}
+	missing := credentials{HTTPPasswordFile: filepath.Join(dir, "missing")}.auth(global)
+	if _, _, err := missing.Credentials(); err == nil {
+		t.Errorf("Expected an error for a password file never read")
+	}
 }
@@ -1,8 +1,10 @@
 package datamonitor
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"log"
+	"strconv"
 	"strings"
 
 	"github.com/elfido/n1qlExporter/cbapi"
@@ -10,6 +12,10 @@ import (
 
 // Monitor for data nodes
 type Monitor struct {
+	ClusterName string
+	Servers     []string
+	HTTPAuth    cbapi.Auth
+	protocol    string
 }
 
 // ClusterMap Couchbase cluster summary
@@ -18,71 +24,408 @@ type ClusterMap struct {
 	QueryNodes []string
 	IndexNodes []string
 	DataNodes  []string
-	TotalNodes int // Different since nodes can share roles
-	Version    string
-	Buckets    []string // Do I really need this?
+	TotalNodes int    // Different since nodes can share roles
+	Version    string // Oldest version in the cluster
+	Buckets    []string
+	BucketInfo []BucketInfo
+	// BucketsCollected is false when the bucket list could not be read
+	BucketsCollected bool
+	ServerGroups     map[string]string // Node -> server group
 }
 
-type couchbaseDefaultResponse struct {
-	Name  string `json:"name"`
-	Nodes []struct {
-		Hostname string   `json:"hostname"`
-		Services []string `json:"services"`
-		Version  string   `json:"version"`
-	} `json:"nodes"`
-	SystemStats struct {
+// BucketInfo Bucket configuration and usage, refreshed on every discovery
+type BucketInfo struct {
+	Name           string
+	Type           string
+	StorageBackend string
+	EvictionPolicy string
+	Durability     string
+	RAMQuota       int64
+	MemoryUsed     int64
+	ItemCount      int64
+	DiskUsed       int64
+	DataUsed       int64
+}
+
+// NodeStatus Health and resource usage of a single cluster node
+type NodeStatus struct {
+	Node              string
+	Version           string
+	Edition           string
+	Services          []string
+	Status            string
+	ClusterMembership string
+	RecoveryType      string
+	CPUUtilization    float64
+	CPUCount          int
+	MemoryTotal       int64
+	MemoryFree        int64
+	SwapTotal         int64
+	SwapUsed          int64
+	Uptime            int64
+}
+
+// RebalanceStatus Current and last rebalance state from the cluster tasks
+type RebalanceStatus struct {
+	Running    bool
+	Progress   float64
+	LastFailed bool
+}
+
+// AutoFailoverSettings Auto-failover configuration and usage
+type AutoFailoverSettings struct {
+	Enabled  bool `json:"enabled"`
+	Timeout  int  `json:"timeout"`
+	Count    int  `json:"count"`
+	MaxCount int  `json:"maxCount"`
+}
+
+// ClusterStatus Collection of node health records
+type ClusterStatus struct {
+	ClusterName  string
+	Nodes        []NodeStatus
+	ServerGroups map[string]string // node -> server group
+	Rebalance    *RebalanceStatus
+	AutoFailover *AutoFailoverSettings
+}
+
+type couchbaseNode struct {
+	Hostname          string   `json:"hostname"`
+	Services          []string `json:"services"`
+	Version           string   `json:"version"`
+	Status            string   `json:"status"`
+	ClusterMembership string   `json:"clusterMembership"`
+	RecoveryType      string   `json:"recoveryType"`
+	Uptime            string   `json:"uptime"`
+	SystemStats       struct {
 		CPUUtilization float64 `json:"cpu_utilization_rate"`
-	}
+		SwapTotal      int64   `json:"swap_total"`
+		SwapUsed       int64   `json:"swap_used"`
+		MemTotal       int64   `json:"mem_total"`
+		MemFree        int64   `json:"mem_free"`
+	} `json:"systemStats"`
 	MemoryTotal int64 `json:"memoryTotal"`
 	MemoryFree  int64 `json:"memoryFree"`
 	CPUCount    int   `json:"cpuCount"`
 }
 
-// Execute calls the monitoring APIs in data nodes
-func (m *Monitor) Execute() {
-	// url := "http://${user}:${password}@${clusterAddress}:8091/pools/default"
+type couchbaseDefaultResponse struct {
+	Name  string          `json:"name"`
+	Nodes []couchbaseNode `json:"nodes"`
+}
 
+type couchbaseBucket struct {
+	Name           string `json:"name"`
+	BucketType     string `json:"bucketType"`
+	StorageBackend string `json:"storageBackend"`
+	EvictionPolicy string `json:"evictionPolicy"`
+	Durability     string `json:"durabilityMinLevel"`
+	Quota          struct {
+		RAM int64 `json:"ram"`
+	} `json:"quota"`
+	BasicStats struct {
+		MemUsed   int64 `json:"memUsed"`
+		ItemCount int64 `json:"itemCount"`
+		DiskUsed  int64 `json:"diskUsed"`
+		DataUsed  int64 `json:"dataUsed"`
+	} `json:"basicStats"`
 }
 
-// NewDataMonitor Creates a data node monitor
-func NewDataMonitor(clusterName string, servers []string, serverAuth cbapi.Auth, useHTTPS bool) {
+type couchbaseTask struct {
+	Type         string  `json:"type"`
+	Status       string  `json:"status"`
+	Progress     float64 `json:"progress"`
+	ErrorMessage string  `json:"errorMessage"`
+}
 
+type couchbaseServerGroupsResponse struct {
+	Groups []struct {
+		Name  string `json:"name"`
+		Nodes []struct {
+			Hostname string `json:"hostname"`
+		} `json:"nodes"`
+	} `json:"groups"`
 }
 
-// GetClusterMap Discovers the nodes of a Couchbase cluster
-func GetClusterMap(server string, auth cbapi.Auth) (ClusterMap, error) {
-	fmt.Printf("Looking for new nodes for cluster %s\n", server)
+func simpleHostName(hostname string) string {
+	return strings.Replace(hostname, ":8091", "", -1)
+}
+
+func getPoolsDefault(ctx context.Context, server string, auth *cbapi.Auth) (couchbaseDefaultResponse, error) {
 	url := server + ":8091/pools/default"
 	var response couchbaseDefaultResponse
-	version := ""
-	bytes := cbapi.GetAPI(url, &auth)
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes, err := cbapi.TryGetAPI(ctx, url, auth)
+	if err != nil {
+		return response, err
+	}
+	err = json.Unmarshal(bytes, &response)
+	return response, err
+}
+
+func getBuckets(ctx context.Context, server string, auth *cbapi.Auth) ([]BucketInfo, error) {
+	url := server + ":8091/pools/default/buckets"
+	var response []couchbaseBucket
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, auth)
+	err := json.Unmarshal(bytes, &response)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]BucketInfo, len(response), len(response))
+	for ndx, bucket := range response {
+		bucketType := bucket.BucketType
+		// membase is the internal name of couchbase buckets
+		if bucketType == "membase" {
+			bucketType = "couchbase"
+		}
+		buckets[ndx] = BucketInfo{
+			Name:           bucket.Name,
+			Type:           bucketType,
+			StorageBackend: bucket.StorageBackend,
+			EvictionPolicy: bucket.EvictionPolicy,
+			Durability:     bucket.Durability,
+			RAMQuota:       bucket.Quota.RAM,
+			MemoryUsed:     bucket.BasicStats.MemUsed,
+			ItemCount:      bucket.BasicStats.ItemCount,
+			DiskUsed:       bucket.BasicStats.DiskUsed,
+			DataUsed:       bucket.BasicStats.DataUsed,
+		}
+	}
+	return buckets, nil
+}
+
+func getRebalanceStatus(ctx context.Context, server string, auth *cbapi.Auth) (*RebalanceStatus, error) {
+	url := server + ":8091/pools/default/tasks"
+	var tasks []couchbaseTask
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, auth)
+	err := json.Unmarshal(bytes, &tasks)
+	if err != nil {
+		return nil, err
+	}
+	status := RebalanceStatus{}
+	for _, task := range tasks {
+		if task.Type == "rebalance" {
+			status.Running = task.Status == "running"
+			status.Progress = task.Progress
+			status.LastFailed = task.ErrorMessage != ""
+		}
+	}
+	return &status, nil
+}
+
+func getAutoFailoverSettings(ctx context.Context, server string, auth *cbapi.Auth) (*AutoFailoverSettings, error) {
+	url := server + ":8091/settings/autoFailover"
+	var settings AutoFailoverSettings
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, auth)
+	err := json.Unmarshal(bytes, &settings)
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// getServerGroups maps every node to its server group, server groups are an
+// enterprise feature so community clusters return an empty map
+func getServerGroups(ctx context.Context, server string, auth *cbapi.Auth) map[string]string {
+	url := server + ":8091/pools/default/serverGroups"
+	var response couchbaseServerGroupsResponse
+	groups := make(map[string]string)
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, auth)
 	err := json.Unmarshal(bytes, &response)
+	if err == nil {
+		for _, group := range response.Groups {
+			for _, node := range group.Nodes {
+				groups[simpleHostName(node.Hostname)] = group.Name
+			}
+		}
+	}
+	return groups
+}
+
+// SplitVersion separates the version reported by a node (6.6.0-7909-enterprise)
+// into build version and edition
+func SplitVersion(fullVersion string) (string, string) {
+	ndx := strings.LastIndex(fullVersion, "-")
+	if ndx < 0 {
+		return fullVersion, ""
+	}
+	edition := fullVersion[ndx+1:]
+	if edition != "enterprise" && edition != "community" {
+		return fullVersion, ""
+	}
+	return fullVersion[:ndx], edition
+}
+
+// versionNumbers returns the numeric components of a version (6.6.0-7909 -> 6, 6, 0, 7909)
+func versionNumbers(version string) []int {
+	numbers := []int{}
+	for _, component := range strings.FieldsFunc(version, func(r rune) bool { return r == '.' || r == '-' }) {
+		number, err := strconv.Atoi(component)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
+
+// CompareVersions returns -1, 0 or 1 when version a is older, equal or newer than b
+func CompareVersions(a string, b string) int {
+	numbersA := versionNumbers(a)
+	numbersB := versionNumbers(b)
+	for ndx := 0; ndx < len(numbersA) && ndx < len(numbersB); ndx++ {
+		if numbersA[ndx] < numbersB[ndx] {
+			return -1
+		}
+		if numbersA[ndx] > numbersB[ndx] {
+			return 1
+		}
+	}
+	if len(numbersA) < len(numbersB) {
+		return -1
+	}
+	if len(numbersA) > len(numbersB) {
+		return 1
+	}
+	return 0
+}
+
+func toNodeStatus(node couchbaseNode) NodeStatus {
+	uptime, err := strconv.ParseInt(node.Uptime, 10, 64)
+	if err != nil {
+		uptime = -1
+	}
+	// Older releases only report memory at the node level, newer ones in systemStats
+	memTotal := node.SystemStats.MemTotal
+	memFree := node.SystemStats.MemFree
+	if memTotal == 0 {
+		memTotal = node.MemoryTotal
+		memFree = node.MemoryFree
+	}
+	version, edition := SplitVersion(node.Version)
+	return NodeStatus{
+		Node:              simpleHostName(node.Hostname),
+		Version:           version,
+		Edition:           edition,
+		Services:          node.Services,
+		Status:            node.Status,
+		ClusterMembership: node.ClusterMembership,
+		RecoveryType:      node.RecoveryType,
+		CPUUtilization:    node.SystemStats.CPUUtilization,
+		CPUCount:          node.CPUCount,
+		MemoryTotal:       memTotal,
+		MemoryFree:        memFree,
+		SwapTotal:         node.SystemStats.SwapTotal,
+		SwapUsed:          node.SystemStats.SwapUsed,
+		Uptime:            uptime,
+	}
+}
+
+// Execute calls the monitoring APIs in data nodes
+func (m *Monitor) Execute(ctx context.Context) ClusterStatus {
+	for _, s := range m.Servers {
+		server := m.protocol + "://" + s
+		response, err := getPoolsDefault(ctx, server, &m.HTTPAuth)
+		if err != nil {
+			log.Printf("Server: %s\nError getting node status:\n%s\n", s, err.Error())
+			continue
+		}
+		nodes := make([]NodeStatus, len(response.Nodes), len(response.Nodes))
+		for ndx, node := range response.Nodes {
+			nodes[ndx] = toNodeStatus(node)
+		}
+		rebalance, err := getRebalanceStatus(ctx, server, &m.HTTPAuth)
+		if err != nil {
+			log.Printf("Server: %s\nError getting cluster tasks:\n%s\n", s, err.Error())
+		}
+		autoFailover, err := getAutoFailoverSettings(ctx, server, &m.HTTPAuth)
+		if err != nil {
+			log.Printf("Server: %s\nError getting auto-failover settings:\n%s\n", s, err.Error())
+		}
+		return ClusterStatus{
+			ClusterName:  m.ClusterName,
+			Nodes:        nodes,
+			ServerGroups: getServerGroups(ctx, server, &m.HTTPAuth),
+			Rebalance:    rebalance,
+			AutoFailover: autoFailover,
+		}
+	}
+	return ClusterStatus{
+		ClusterName:  m.ClusterName,
+		Nodes:        []NodeStatus{},
+		ServerGroups: map[string]string{},
+	}
+}
+
+// NewDataMonitor Creates a data node monitor
+func NewDataMonitor(clusterName string, servers []string, serverAuth cbapi.Auth, useHTTPS bool) Monitor {
+	protocol := "http"
+	if useHTTPS == true {
+		protocol = "https"
+	}
+	return Monitor{
+		ClusterName: clusterName,
+		Servers:     servers,
+		HTTPAuth:    serverAuth,
+		protocol:    protocol,
+	}
+}
+
+// GetClusterMap Discovers the nodes of a Couchbase cluster
+func GetClusterMap(ctx context.Context, server string, auth cbapi.Auth) (ClusterMap, error) {
+	log.Printf("Looking for new nodes for cluster %s\n", server)
+	version := ""
+	response, err := getPoolsDefault(ctx, server, &auth)
 	if err == nil {
 		kvNodes := make([]string, 0, 0)
 		n1qlNodes := make([]string, 0, 0)
 		indexNodes := make([]string, 0, 0)
 		for _, node := range response.Nodes {
 			for _, service := range node.Services {
-				simpleHostName := strings.Replace(node.Hostname, ":8091", "", -1)
+				hostName := simpleHostName(node.Hostname)
 				if service == "kv" {
-					kvNodes = append(kvNodes, simpleHostName)
+					kvNodes = append(kvNodes, hostName)
 				}
 				if service == "n1ql" {
-					n1qlNodes = append(n1qlNodes, simpleHostName)
+					n1qlNodes = append(n1qlNodes, hostName)
 				}
 				if service == "index" {
-					indexNodes = append(indexNodes, simpleHostName)
+					indexNodes = append(indexNodes, hostName)
 				}
 			}
-			version = node.Version
+			// Mixed clusters (e.g. during an upgrade) are handled as the oldest version
+			if version == "" || CompareVersions(node.Version, version) < 0 {
+				version = node.Version
+			}
+		}
+		bucketInfo, bucketErr := getBuckets(ctx, server, &auth)
+		if bucketErr != nil {
+			log.Printf("Error getting buckets for cluster %s: %s\n", server, bucketErr.Error())
+		}
+		buckets := make([]string, len(bucketInfo), len(bucketInfo))
+		for ndx, bucket := range bucketInfo {
+			buckets[ndx] = bucket.Name
 		}
 		return ClusterMap{
-			Name:       response.Name,
-			TotalNodes: len(response.Nodes),
-			QueryNodes: n1qlNodes,
-			DataNodes:  kvNodes,
-			Version:    version,
-			IndexNodes: indexNodes,
+			Name:             response.Name,
+			TotalNodes:       len(response.Nodes),
+			QueryNodes:       n1qlNodes,
+			DataNodes:        kvNodes,
+			Version:          version,
+			IndexNodes:       indexNodes,
+			Buckets:          buckets,
+			BucketInfo:       bucketInfo,
+			BucketsCollected: bucketErr == nil,
+			ServerGroups:     getServerGroups(ctx, server, &auth),
 		}, nil
 	}
 	return ClusterMap{}, err
@@ -0,0 +1,16 @@
+package datamonitor
+
+import "testing"
+
+func TestVersionParsing(t *testing.T) {
+	version, edition := SplitVersion("6.6.0-7909-enterprise")
+	if version != "6.6.0-7909" || edition != "enterprise" {
+		t.Errorf("Unexpected version %s and edition %s", version, edition)
+	}
+	if CompareVersions("5.5.2-3733-community", "6.0.0-1693-enterprise") != -1 {
+		t.Errorf("Expected 5.5.2 to be older than 6.0.0")
+	}
+	if CompareVersions("6.6.0-7909", "6.6.0-7909-enterprise") != 0 {
+		t.Errorf("Expected versions to be equal regardless of edition")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// discoveries Clusters discovered successfully since the exporter started
+var discoveries int32
+
+// shuttingDown Set once the exporter started shutting down
+var shuttingDown int32
+
+func recordDiscovery() {
+	atomic.AddInt32(&discoveries, 1)
+}
+
+// healthyHandler answers while the exporter is running
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "N1QL exporter is healthy.\n")
+}
+
+// readyHandler answers once a cluster was discovered, until the exporter
+// starts shutting down
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		http.Error(w, "N1QL exporter is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.LoadInt32(&discoveries) == 0 {
+		http.Error(w, "N1QL exporter has not discovered any cluster yet.", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "N1QL exporter is ready.\n")
+}
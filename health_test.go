@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyHandler(t *testing.T) {
+	atomic.StoreInt32(&discoveries, 0)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	status := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	if code := status(readyHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready before any discovery, found %d", code)
+	}
+	recordDiscovery()
+	if code := status(readyHandler); code != http.StatusOK {
+		t.Errorf("Expected ready after a discovery, found %d", code)
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+	if code := status(readyHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while shutting down, found %d", code)
+	}
+	if code := status(healthyHandler); code != http.StatusOK {
+		t.Errorf("Expected healthy while shutting down, found %d", code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	atomic.StoreInt32(&discoveries, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	server := &http.Server{Handler: http.HandlerFunc(readyHandler)}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		// A cluster worker stops once its scrapes are aborted
+		<-ctx.Done()
+		close(stopped)
+	}()
+	result := make(chan bool, 1)
+	go func() {
+		result <- shutdown(server, cancel, stopped, 500*time.Millisecond, time.Second)
+	}()
+	// New connections are still accepted during the drain and told to go away
+	drained := false
+	for start := time.Now(); time.Since(start) < 400*time.Millisecond && !drained; {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		response, err := client.Get("http://" + listener.Addr().String() + "/-/ready")
+		if err != nil {
+			t.Fatalf("Expected the server to accept connections while draining, found %s", err.Error())
+		}
+		response.Body.Close()
+		drained = response.StatusCode == http.StatusServiceUnavailable
+	}
+	if !drained {
+		t.Errorf("Expected /-/ready to answer 503 while draining")
+	}
+	if !<-result {
+		t.Errorf("Expected the workers to stop within the timeout")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected the server to be closed, found %v", err)
+	}
+	if shutdown(&http.Server{}, func() {}, make(chan struct{}), 0, 10*time.Millisecond) {
+		t.Errorf("Expected workers that don't stop to be reported")
+	}
+}
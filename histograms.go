@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramSettings Histogram buckets per metric name
+type histogramSettings struct {
+	Buckets map[string][]float64 `json:"buckets"`
+}
+
+// validateBuckets checks buckets are in increasing order
+func validateBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("no buckets")
+	}
+	for ndx := 1; ndx < len(buckets); ndx++ {
+		if buckets[ndx] <= buckets[ndx-1] {
+			return fmt.Errorf("buckets must be in increasing order, %v is not greater than %v", buckets[ndx], buckets[ndx-1])
+		}
+	}
+	return nil
+}
+
+// newHistogramVec builds a histogram with the buckets configured for its name,
+// or the default ones when not configured or invalid
+func newHistogramVec(settings histogramSettings, name string, help string, buckets []float64, labels []string) *prometheus.HistogramVec {
+	opts := prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}
+	if configured, found := settings.Buckets[name]; found {
+		if err := validateBuckets(configured); err != nil {
+			log.Printf("Invalid buckets for %s, using the default ones: %s\n", name, err.Error())
+		} else {
+			opts.Buckets = configured
+		}
+	}
+	return prometheus.NewHistogramVec(opts, labels)
+}
+
+// checkHistogramSettings warns about settings that won't be used
+func checkHistogramSettings(settings histogramSettings, names []string) {
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+	}
+	for name := range settings.Buckets {
+		if !known[name] {
+			log.Printf("Buckets configured for unknown histogram %s\n", name)
+		}
+	}
+}
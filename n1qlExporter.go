@@ -1,119 +1,655 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/elfido/n1qlExporter/cbapi"
 
 	"github.com/elfido/n1qlExporter/datamonitor"
 	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/elfido/n1qlExporter/xdcrmonitor"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 )
 
 var listenAddr = flag.String("listen", ":8380", "Address to listen for HTTP requests")
+var configFileFlag = flag.String("config.file", "", "Configuration file, JSON, YAML or TOML by extension (default settings.json in the working directory)")
+var configCheck = flag.Bool("config.check", false, "Validate the configuration, print every problem found and exit (non-zero when invalid)")
+var webConfigFile = flag.String("web.config.file", "", "Web configuration file enabling TLS and basic authentication on the listener")
+var legacyActiveMetrics = flag.Bool("active.legacy-metrics", false, "Also expose n1ql_active_consistency and n1ql_active_accumulated_queries for existing dashboards")
+var legacyHistogramMetrics = flag.Bool("histograms.legacy-metrics", false, "Also expose the latency histograms under their former names in milliseconds (n1ql_active_time_execution, ...) for existing dashboards")
+var shutdownDrain = flag.Duration("web.shutdown-drain", 5*time.Second, "Time /-/ready answers 503 on shutdown before the listener is closed, so load balancers stop sending requests")
 
 const exporterVersion = "1.0.1"
 
+const (
+	scrapeInterval    = 15 * time.Second
+	minScrapeInterval = 3 * time.Second
+	renewInterval     = 10 * scrapeInterval
+	shutdownTimeout   = 10 * time.Second
+)
+
+// clusterMonitor groups the monitors running against a single cluster
+type clusterMonitor struct {
+	definition       configuration
+	query            n1qlmonitor.Monitor
+	data             datamonitor.Monitor
+	xdcr             xdcrmonitor.Monitor
+	serverGroups     map[string]string
+	preparedTop      int
+	adaptiveInterval bool // Shorten the interval when the completed requests buffer overflows
+	interval         time.Duration
+}
+
+// reportedBuckets and reportedNodes keep the info labels exported per cluster
+// so dropped or changed buckets and nodes don't leave stale series behind
+var reportedBuckets = make(map[string]map[string][]string)
+var reportedNodes = make(map[string]map[string][]string)
+
+// activeIdleScrapes Scrapes a combination of n1ql_active_queries stays at zero
+// before it is removed
+const activeIdleScrapes = 10
+
+// activeCombination Labels of a n1ql_active_queries series and the scrapes it
+// has been zero for
+type activeCombination struct {
+	labels []string
+	idle   int
+}
+
 func init() {
 	initN1QLMetrics()
+	initClusterMetrics()
+	initXDCRMetrics()
+	initVitalsMetrics()
+	initQuantileMetrics()
 }
 
-func discoverCluster(hostName string, auth cbapi.Auth) (datamonitor.ClusterMap, error) {
-	return datamonitor.GetClusterMap(hostName, auth)
+func discoverCluster(ctx context.Context, hostName string, auth cbapi.Auth) (datamonitor.ClusterMap, error) {
+	return datamonitor.GetClusterMap(ctx, hostName, auth)
 }
 
-func getMonitors() []n1qlmonitor.Monitor {
-	monitorDefinitions := getConfigurationDefs()
-	monitors := make([]n1qlmonitor.Monitor, len(monitorDefinitions), len(monitorDefinitions))
-	for ndx, definition := range monitorDefinitions {
-		if len(definition.hosts) > 0 {
-			protocol := "http"
-			if definition.useHTTPS {
-				protocol = "https"
-			}
-			server := protocol + "://" + definition.hosts[0]
-			clusterMap, err := discoverCluster(server, definition.auth)
-			if err == nil {
-				definition.clusterName = strings.ToUpper(definition.clusterName)
-				log.Printf("Registering monitor %s for hosts: %v\n", definition.clusterName, clusterMap.QueryNodes)
-				datelayout := time.RFC3339Nano
-				versionsplit := strings.Split(clusterMap.Version, ".")
-				if versionsplit[0] == "5" {
-					datelayout = "2006-01-02 15:04:05.999999999 -0700 MST"
-				}
-				mon := n1qlmonitor.New(definition.clusterName, clusterMap.QueryNodes, definition.auth, definition.useHTTPS, datelayout)
-				monitors[ndx] = mon
-			} else {
-				fmt.Printf("Cannot discover cluster %s: %s\n", definition.clusterName, err.Error())
-			}
+// dateLayout returns the layout of the request times reported by the query service
+func dateLayout(version string) string {
+	versionsplit := strings.Split(version, ".")
+	if versionsplit[0] == "5" {
+		return "2006-01-02 15:04:05.999999999 -0700 MST"
+	}
+	return time.RFC3339Nano
+}
+
+// newClusterMonitor discovers the cluster of a definition and builds its
+// monitors, a cluster that cannot be discovered is retried on every renewal
+func newClusterMonitor(ctx context.Context, definition configuration) (*clusterMonitor, error) {
+	monitor := &clusterMonitor{
+		definition: definition,
+		interval:   definition.scrape.interval,
+	}
+	if len(definition.hosts) == 0 {
+		return monitor, fmt.Errorf("no hosts")
+	}
+	protocol := "http"
+	if definition.useHTTPS {
+		protocol = "https"
+	}
+	server := protocol + "://" + definition.hosts[0]
+	clusterMap, err := discoverCluster(ctx, server, definition.auth)
+	if err != nil {
+		return monitor, err
+	}
+	recordDiscovery()
+	clusterName := definition.name
+	log.Printf("Registering monitor %s for hosts: %v\n", clusterName, clusterMap.QueryNodes)
+	// Keep the bucket series when the bucket list could not be read
+	if clusterMap.BucketsCollected {
+		reportMutex.Lock()
+		reportBucketMetrics(clusterName, clusterMap.BucketInfo)
+		reportMutex.Unlock()
+	}
+	mon := n1qlmonitor.New(clusterName, clusterMap.QueryNodes, definition.auth, definition.useHTTPS, dateLayout(clusterMap.Version))
+	mon.SetLongRunningThresholds(definition.longRunning)
+	mon.SetQuantiles(definition.quantiles)
+	if definition.cancel != nil {
+		if err := mon.SetCancelPolicy(*definition.cancel); err != nil {
+			log.Printf("Invalid cancel policy for %s, queries won't be cancelled: %s\n", clusterName, err.Error())
+		} else if definition.cancel.Enabled {
+			log.Printf("Cancel policy enabled for %s (dry run: %v)\n", clusterName, definition.cancel.DryRun)
 		}
 	}
-	return monitors
+	if definition.completed != nil {
+		completed := *definition.completed
+		if len(completed.Qualifiers) > 0 && datamonitor.CompareVersions(clusterMap.Version, "6.5.0") < 0 {
+			log.Printf("Completed requests qualifiers require Couchbase 6.5 or later, ignoring them for %s\n", clusterName)
+			completed.Qualifiers = nil
+		}
+		mon.ManageCompletedSettings(completed)
+	}
+	monitor.query = mon
+	monitor.data = datamonitor.NewDataMonitor(clusterName, definition.hosts, definition.auth, definition.useHTTPS)
+	monitor.xdcr = xdcrmonitor.New(clusterName, definition.hosts, definition.auth, definition.useHTTPS)
+	monitor.preparedTop = definition.preparedTop
+	monitor.adaptiveInterval = definition.adaptiveInterval
+	return monitor, nil
 }
 
-func reportMetrics(metrics *n1qlmonitor.ClusterResponse) {
+// renew discovers the query nodes of the cluster again, keeping the state of
+// its monitors
+func (c *clusterMonitor) renew(ctx context.Context) {
+	if len(c.query.Servers) == 0 {
+		fresh, err := newClusterMonitor(ctx, c.definition)
+		if err != nil {
+			log.Printf("Cannot discover cluster %s: %s\n", c.definition.clusterName, err.Error())
+			return
+		}
+		*c = *fresh
+		return
+	}
+	protocol := "http"
+	if c.definition.useHTTPS {
+		protocol = "https"
+	}
+	clusterMap, err := discoverCluster(ctx, protocol+"://"+c.definition.hosts[0], c.definition.auth)
+	if err != nil {
+		log.Printf("Cannot discover cluster %s: %s\n", c.query.ClusterName, err.Error())
+		return
+	}
+	recordDiscovery()
+	log.Printf("Renewing nodes for %s\n", c.query.ClusterName)
+	// Keep the bucket series when the bucket list could not be read
+	if clusterMap.BucketsCollected {
+		reportMutex.Lock()
+		reportBucketMetrics(c.query.ClusterName, clusterMap.BucketInfo)
+		reportMutex.Unlock()
+	}
+	c.query.Servers = clusterMap.QueryNodes
+}
+
+// report exports the query service metrics of a scrape, top is the prepared
+// statements reported per node
+func (m *queryMetrics) report(metrics *n1qlmonitor.ClusterResponse, serverGroups map[string]string, top int) {
 	for _, server := range metrics.ServerResponses {
+		group := serverGroups[server.Node]
+		if server.TimedOut {
+			m.scrapeTimeouts.WithLabelValues(metrics.ClusterName, server.Node, group).Inc()
+			continue
+		}
 		// Active queries report
 		for _, query := range server.Active {
-			activeExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, query.QueryType).Observe(float64(query.ExecutionTime))
-			activeWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, query.QueryType).Observe(float64(query.WaitingTime))
-			activeScanConsistency.WithLabelValues(metrics.ClusterName, query.ScanConsistency).Inc()
+			m.activeExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(millisToSeconds(query.ExecutionTime))
+			m.activeWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(millisToSeconds(query.WaitingTime))
+			if *legacyHistogramMetrics {
+				m.legacyActiveExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(float64(query.ExecutionTime))
+				m.legacyActiveWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(float64(query.WaitingTime))
+			}
+			if *legacyActiveMetrics {
+				m.activeScanConsistency.WithLabelValues(metrics.ClusterName, query.ScanConsistency).Inc()
+			}
+		}
+		if *legacyActiveMetrics {
+			m.activeAccumulation.WithLabelValues(metrics.ClusterName, server.Node, group).Observe(float64(len(server.Active)))
+		}
+		if server.ActiveCollected {
+			m.reportActiveQueries(metrics.ClusterName, group, &server)
+			m.activeOldest.WithLabelValues(metrics.ClusterName, server.Node, group).Set(server.OldestActive)
+			for ndx, threshold := range metrics.LongRunningThresholds {
+				m.activeOverThreshold.WithLabelValues(metrics.ClusterName, server.Node, group, strconv.FormatFloat(threshold.Seconds(), 'f', -1, 64)).Set(float64(server.ActiveOverThreshold[ndx]))
+			}
+			for _, runaway := range server.Runaways {
+				logRunawayQuery(metrics.ClusterName, runaway)
+			}
+			for _, cancellation := range server.Cancellations {
+				result := "cancelled"
+				if cancellation.DryRun {
+					result = "dry_run"
+				} else if cancellation.Error != nil {
+					result = "error"
+				}
+				m.cancelledQueries.WithLabelValues(metrics.ClusterName, server.Node, group, cancellation.Rule, result).Inc()
+			}
 		}
-		activeAccumulation.WithLabelValues(metrics.ClusterName, server.Node).Observe(float64(len(server.Active)))
 
 		// Completed queries report
 		for _, query := range server.Completed {
-			completedResultCount.WithLabelValues(metrics.ClusterName, query.QueryType).Observe(float64(query.ResultCount))
-			completedResultSize.WithLabelValues(metrics.ClusterName, query.QueryType).Observe(float64(query.ResultSize))
-			completedExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, query.QueryType, query.State).Observe(float64(query.ExecutionTime))
-			completedWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, query.QueryType).Observe(float64(query.WaitingTime))
+			m.completedResultCount.WithLabelValues(metrics.ClusterName, query.QueryType).Observe(float64(query.ResultCount))
+			m.completedResultSize.WithLabelValues(metrics.ClusterName, query.QueryType).Observe(float64(query.ResultSize))
+			m.completedExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType, query.State).Observe(millisToSeconds(query.ExecutionTime))
+			m.completedWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(millisToSeconds(query.WaitingTime))
+			if *legacyHistogramMetrics {
+				m.legacyCompletedExecutionTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType, query.State).Observe(float64(query.ExecutionTime))
+				m.legacyCompletedWaitingTime.WithLabelValues(metrics.ClusterName, server.Node, group, query.QueryType).Observe(float64(query.WaitingTime))
+			}
 			if query.PhaseCounts.PrimaryScan > 0 || query.PhaseOperators.PrimaryScan > 0 {
-				completedPrimaryIndexUse.WithLabelValues(metrics.ClusterName, query.QueryType).Inc()
+				m.completedPrimaryIndexUse.WithLabelValues(metrics.ClusterName, query.QueryType).Inc()
 			}
 		}
 
 		// Vitals report
-		completedVitals.WithLabelValues(metrics.ClusterName, server.Node).Set(float64(server.CompletedQueriesCount))
-		cpuVitals.WithLabelValues(metrics.ClusterName, server.Node, "user").Set(float64(server.CPUUser))
-		cpuVitals.WithLabelValues(metrics.ClusterName, server.Node, "system").Set(float64(server.CPUSystem))
+		m.completedVitals.WithLabelValues(metrics.ClusterName, server.Node, group).Set(float64(server.CompletedQueriesCount))
+		m.cpuVitals.WithLabelValues(metrics.ClusterName, server.Node, group, "user").Set(float64(server.CPUUser))
+		m.cpuVitals.WithLabelValues(metrics.ClusterName, server.Node, group, "system").Set(float64(server.CPUSystem))
+
+		// Settings report
+		for setting, value := range server.Settings {
+			m.querySettings.WithLabelValues(metrics.ClusterName, server.Node, group, setting).Set(value)
+			m.querySettingsDrift.WithLabelValues(metrics.ClusterName, server.Node, group, setting).Set(boolToFloat(server.SettingsDrift[setting]))
+		}
+		if server.CompletedOverflow {
+			m.completedOverflows.WithLabelValues(metrics.ClusterName, server.Node, group).Inc()
+			m.completedLost.WithLabelValues(metrics.ClusterName, server.Node, group).Add(float64(server.CompletedLost))
+		}
+		if server.CompletedSettingsManaged {
+			m.completedSettingsInEffect.WithLabelValues(metrics.ClusterName, server.Node, group).Set(boolToFloat(server.CompletedSettingsInEffect))
+		}
+	}
+	m.vitals.update(metrics, serverGroups)
+	m.quantiles.update(metrics)
+	m.reportPrepareds(metrics, serverGroups, top)
+}
+
+// reportActiveQueries sets the active queries per type, scan consistency and
+// state of a node, combinations seen before and not active anymore are set to 0
+// and removed after activeIdleScrapes scrapes
+func (m *queryMetrics) reportActiveQueries(clusterName string, group string, server *n1qlmonitor.ServerResponse) {
+	node := server.Node
+	counts := make(map[string]float64)
+	combinations := make(map[string]activeCombination)
+	for _, query := range server.Active {
+		queryLabels := []string{clusterName, node, group, query.QueryType, query.ScanConsistency, query.State}
+		key := strings.Join(queryLabels, "\x00")
+		counts[key]++
+		combinations[key] = activeCombination{labels: queryLabels}
+	}
+	if m.reportedActive[clusterName] == nil {
+		m.reportedActive[clusterName] = make(map[string]map[string]activeCombination)
+	}
+	for key, previous := range m.reportedActive[clusterName][node] {
+		if _, found := counts[key]; found {
+			continue
+		}
+		previous.idle++
+		if previous.idle >= activeIdleScrapes {
+			m.activeQueries.DeleteLabelValues(previous.labels...)
+			continue
+		}
+		m.activeQueries.WithLabelValues(previous.labels...).Set(0)
+		combinations[key] = previous
+	}
+	for key, count := range counts {
+		m.activeQueries.WithLabelValues(combinations[key].labels...).Set(count)
+	}
+	m.reportedActive[clusterName][node] = combinations
+}
+
+// logRunawayQuery writes a JSON event for a query that crossed a long running threshold
+func logRunawayQuery(clusterName string, query n1qlmonitor.RunawayQuery) {
+	event, _ := json.Marshal(map[string]interface{}{
+		"event":           "long_running_query",
+		"cluster":         clusterName,
+		"node":            query.Node,
+		"requestID":       query.RequestID,
+		"elapsed":         query.Elapsed.Seconds(),
+		"threshold":       query.Threshold.Seconds(),
+		"fingerprint":     query.Fingerprint,
+		"statement":       query.Statement,
+		"users":           query.Users,
+		"clientContextID": query.ClientContextID,
+	})
+	log.Println(string(event))
+}
+
+func (m *queryMetrics) reportPrepareds(metrics *n1qlmonitor.ClusterResponse, serverGroups map[string]string, top int) {
+	reported := m.reportedPrepareds[metrics.ClusterName]
+	if reported == nil {
+		reported = make(map[string][][]string)
+		m.reportedPrepareds[metrics.ClusterName] = reported
+	}
+	for _, server := range metrics.ServerResponses {
+		if !server.PreparedCollected {
+			continue
+		}
+		group := serverGroups[server.Node]
+		m.preparedCacheSize.WithLabelValues(metrics.ClusterName, server.Node, group).Set(float64(len(server.Prepareds)))
+		m.preparedEvictions.WithLabelValues(metrics.ClusterName, server.Node, group).Add(float64(server.PreparedEvictions))
+		m.preparedReprepares.WithLabelValues(metrics.ClusterName, server.Node, group).Add(float64(server.PreparedReprepares))
+		for _, labels := range reported[server.Node] {
+			m.preparedUses.DeleteLabelValues(labels...)
+			m.preparedAvgServiceTime.DeleteLabelValues(labels...)
+		}
+		current := [][]string{}
+		for ndx, prepared := range server.Prepareds {
+			if ndx >= top {
+				break
+			}
+			labels := []string{metrics.ClusterName, server.Node, group, prepared.Name}
+			m.preparedUses.WithLabelValues(labels...).Set(float64(prepared.Uses))
+			m.preparedAvgServiceTime.WithLabelValues(labels...).Set(prepared.AvgServiceTime)
+			current = append(current, labels)
+		}
+		reported[server.Node] = current
+	}
+}
+
+// setStateGauge sets the current state to 1 and every other known state to 0,
+// the state is the last label of the gauge
+func setStateGauge(gauge *prometheus.GaugeVec, known []string, current string, labels ...string) {
+	found := false
+	for _, value := range known {
+		if value == current {
+			found = true
+			gauge.WithLabelValues(append(labels, value)...).Set(1)
+		} else {
+			gauge.WithLabelValues(append(labels, value)...).Set(0)
+		}
+	}
+	if !found && current != "" {
+		gauge.WithLabelValues(append(labels, current)...).Set(1)
 	}
 }
 
+// setInfoGauge exports an info series for key, removing the series previously
+// exported for the same key if its labels changed
+func setInfoGauge(gauge *prometheus.GaugeVec, reported map[string][]string, key string, labels []string) {
+	if oldLabels, found := reported[key]; found && strings.Join(oldLabels, ",") != strings.Join(labels, ",") {
+		gauge.DeleteLabelValues(oldLabels...)
+	}
+	gauge.WithLabelValues(labels...).Set(1)
+	reported[key] = labels
+}
+
+func millisToSeconds(millis int64) float64 {
+	return float64(millis) / 1000
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// forgetNode deletes the series of a node that left the cluster or moved to
+// another server group, they are labeled with its previous group
+func forgetNode(clusterName string, node string, group string) {
+	for _, vector := range clusterVectors() {
+		deleteSeries(vector, prometheus.Labels{"cluster": clusterName, "node": node, "server_group": group})
+	}
+	delete(scrapeMetrics.reportedActive[clusterName], node)
+	delete(scrapeMetrics.reportedPrepareds[clusterName], node)
+}
+
+func reportClusterMetrics(status *datamonitor.ClusterStatus) {
+	previousNodes := reportedNodes[status.ClusterName]
+	if previousNodes == nil {
+		previousNodes = make(map[string][]string)
+	}
+	currentNodes := make(map[string][]string)
+	for _, node := range status.Nodes {
+		group := status.ServerGroups[node.Node]
+		if oldLabels, found := previousNodes[node.Node]; found && oldLabels[2] != group {
+			forgetNode(status.ClusterName, node.Node, oldLabels[2])
+		}
+		services := append([]string{}, node.Services...)
+		sort.Strings(services)
+		setInfoGauge(nodeInfo, previousNodes, node.Node, []string{status.ClusterName, node.Node, group, node.Version, node.Edition, strings.Join(services, ",")})
+		currentNodes[node.Node] = previousNodes[node.Node]
+		setStateGauge(nodeStatus, nodeStatuses, node.Status, status.ClusterName, node.Node, group)
+		setStateGauge(nodeMembership, nodeMemberships, node.ClusterMembership, status.ClusterName, node.Node, group)
+		setStateGauge(nodeRecoveryType, nodeRecoveryTypes, node.RecoveryType, status.ClusterName, node.Node, group)
+		nodeCPUUtilization.WithLabelValues(status.ClusterName, node.Node, group).Set(node.CPUUtilization)
+		nodeCPUCount.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.CPUCount))
+		nodeMemoryTotal.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.MemoryTotal))
+		nodeMemoryFree.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.MemoryFree))
+		nodeSwapTotal.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.SwapTotal))
+		nodeSwapUsed.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.SwapUsed))
+		if node.Uptime >= 0 {
+			nodeUptime.WithLabelValues(status.ClusterName, node.Node, group).Set(float64(node.Uptime))
+		}
+	}
+	if len(status.Nodes) > 0 {
+		for node, oldLabels := range previousNodes {
+			if _, found := currentNodes[node]; !found {
+				forgetNode(status.ClusterName, node, oldLabels[2])
+			}
+		}
+		reportedNodes[status.ClusterName] = currentNodes
+	}
+	if status.Rebalance != nil {
+		rebalanceRunning.WithLabelValues(status.ClusterName).Set(boolToFloat(status.Rebalance.Running))
+		rebalanceProgress.WithLabelValues(status.ClusterName).Set(status.Rebalance.Progress)
+		outcome := "success"
+		if status.Rebalance.LastFailed {
+			outcome = "failed"
+		}
+		setStateGauge(rebalanceLastOutcome, rebalanceOutcomes, outcome, status.ClusterName)
+	}
+	if status.AutoFailover != nil {
+		autoFailoverEnabled.WithLabelValues(status.ClusterName).Set(boolToFloat(status.AutoFailover.Enabled))
+		autoFailoverTimeout.WithLabelValues(status.ClusterName).Set(float64(status.AutoFailover.Timeout))
+		autoFailoverCount.WithLabelValues(status.ClusterName).Set(float64(status.AutoFailover.Count))
+		autoFailoverMaxCount.WithLabelValues(status.ClusterName).Set(float64(status.AutoFailover.MaxCount))
+	}
+}
+
+func reportBucketMetrics(clusterName string, buckets []datamonitor.BucketInfo) {
+	previous := reportedBuckets[clusterName]
+	if previous == nil {
+		previous = make(map[string][]string)
+	}
+	current := make(map[string][]string)
+	for _, bucket := range buckets {
+		infoLabels := []string{clusterName, bucket.Name, bucket.Type, bucket.StorageBackend, bucket.EvictionPolicy, bucket.Durability}
+		setInfoGauge(bucketInfo, previous, bucket.Name, infoLabels)
+		bucketRAMQuota.WithLabelValues(clusterName, bucket.Name).Set(float64(bucket.RAMQuota))
+		bucketMemoryUsed.WithLabelValues(clusterName, bucket.Name).Set(float64(bucket.MemoryUsed))
+		bucketItems.WithLabelValues(clusterName, bucket.Name).Set(float64(bucket.ItemCount))
+		bucketDiskUsed.WithLabelValues(clusterName, bucket.Name).Set(float64(bucket.DiskUsed))
+		bucketDataUsed.WithLabelValues(clusterName, bucket.Name).Set(float64(bucket.DataUsed))
+		current[bucket.Name] = infoLabels
+	}
+	for name, oldLabels := range previous {
+		if _, found := current[name]; !found {
+			bucketInfo.DeleteLabelValues(oldLabels...)
+			bucketRAMQuota.DeleteLabelValues(clusterName, name)
+			bucketMemoryUsed.DeleteLabelValues(clusterName, name)
+			bucketItems.DeleteLabelValues(clusterName, name)
+			bucketDiskUsed.DeleteLabelValues(clusterName, name)
+			bucketDataUsed.DeleteLabelValues(clusterName, name)
+		}
+	}
+	reportedBuckets[clusterName] = current
+}
+
+// adaptInterval halves the scrape interval of the cluster when the completed
+// requests buffer of any node overflowed and slowly restores it afterwards
+func (c *clusterMonitor) adaptInterval(metrics *n1qlmonitor.ClusterResponse) {
+	overflow := false
+	for _, server := range metrics.ServerResponses {
+		overflow = overflow || server.CompletedOverflow
+	}
+	if overflow {
+		c.interval = c.interval / 2
+		if c.interval < minScrapeInterval {
+			c.interval = minScrapeInterval
+		}
+		log.Printf("Completed requests buffer overflow in %s, scraping every %s\n", metrics.ClusterName, c.interval)
+	} else if c.interval < c.definition.scrape.interval {
+		c.interval = c.interval + time.Second
+		if c.interval > c.definition.scrape.interval {
+			c.interval = c.definition.scrape.interval
+		}
+	}
+	scrapeIntervalSeconds.WithLabelValues(metrics.ClusterName).Set(c.interval.Seconds())
+}
+
+// execute scrapes the cluster and reports the metrics once everything was
+// collected, so the reports of other clusters are only held back briefly.
+// Nothing is reported when ctx is done during the scrape.
+func (c *clusterMonitor) execute(ctx context.Context) {
+	var status datamonitor.ClusterStatus
+	if len(c.data.Servers) > 0 {
+		status = c.data.Execute(ctx)
+		c.serverGroups = status.ServerGroups
+	}
+	c.query.SetScrapeLimits(c.definition.scrape.nodeTimeout(c.interval), c.definition.scrape.concurrency)
+	metrics := c.query.Execute(ctx)
+	var replications xdcrmonitor.ClusterResponse
+	if len(c.xdcr.Servers) > 0 {
+		replications = c.xdcr.Execute(ctx)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	if len(c.data.Servers) > 0 {
+		reportClusterMetrics(&status)
+	}
+	scrapeMetrics.report(&metrics, c.serverGroups, c.preparedTop)
+	if c.adaptiveInterval {
+		c.adaptInterval(&metrics)
+	}
+	if len(c.xdcr.Servers) > 0 {
+		clusterReplications.update(&replications)
+	}
+}
+
+// checkConfiguration prints the problems found in the configuration and
+// returns the exit code
+func checkConfiguration() int {
+	problems := validateConfiguration()
+	if len(problems) > 0 {
+		fmt.Printf("Invalid configuration:\n%s\n", problems.Error())
+		return 1
+	}
+	if _, err := readWebConfig(*webConfigFile); err != nil {
+		fmt.Printf("Invalid web configuration:\n%s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Configuration %s is valid\n", viper.ConfigFileUsed())
+	return 0
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	configFile = *configFileFlag
+	if *configCheck {
+		os.Exit(checkConfiguration())
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Arg(0)))
+	}
 	fmt.Printf("Version: %s\n", exporterVersion)
-	monitors := getMonitors()
-	renewCounter := 0
+	web, err := readWebConfig(*webConfigFile)
+	if err != nil {
+		log.Fatalf("Invalid web configuration: %s\n", err.Error())
+	}
+	tlsConfig, err := web.tlsConfig()
+	if err != nil {
+		log.Fatalf("Invalid web configuration: %s\n", err.Error())
+	}
+	initHistogramMetrics(getHistogramSettings())
+	if *legacyActiveMetrics {
+		initLegacyActiveMetrics()
+	}
+	if *legacyHistogramMetrics {
+		initLegacyHistogramMetrics()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := make(map[string]*clusterWorker)
+	if err := reloadConfiguration(ctx, workers); err != nil {
+		log.Fatalf("Invalid configuration:\n%s\n", err.Error())
+	}
+	watchReloadSignals()
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		for {
-			for ndx := range monitors {
-				metrics := monitors[ndx].Execute()
-				reportMetrics(&metrics)
-			}
-			renewCounter++
-			if renewCounter%10 == 0 {
-				tmpMonitors := getMonitors()
-				for ndx, mon := range tmpMonitors {
-					if mon.ClusterName == monitors[ndx].ClusterName || monitors[ndx].ClusterName == "" {
-						fmt.Printf("Renewing nodes for %s\n", monitors[ndx].ClusterName)
-						if monitors[ndx].ClusterName == "" || len(monitors[ndx].Servers) == 0 {
-							monitors[ndx] = mon
-						} else {
-							monitors[ndx].Servers = mon.Servers
-						}
-					}
+			select {
+			case result := <-reloadRequests:
+				err := reloadConfiguration(ctx, workers)
+				if err != nil {
+					log.Printf("Configuration reload failed, keeping the current one: %s\n", err.Error())
+				}
+				if result != nil {
+					result <- err
 				}
-				renewCounter = 0
+			case <-ctx.Done():
+				for _, worker := range workers {
+					worker.stopAndWait()
+				}
+				return
 			}
-			time.Sleep(15 * time.Second)
 		}
 	}()
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Serving at %s", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	http.Handle("/metrics", promhttp.HandlerFor(clusterRelabeler, promhttp.HandlerOpts{}))
+	http.HandleFunc("/probe", probeHandler)
+	http.HandleFunc("/-/reload", reloadHandler)
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/-/ready", readyHandler)
+	server := &http.Server{
+		Addr:      *listenAddr,
+		Handler:   web.authenticate(http.DefaultServeMux),
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		log.Printf("Serving at %s", *listenAddr)
+		var err error
+		if tlsConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+	received := <-terminate
+	log.Printf("Received %s, shutting down\n", received)
+	shutdown(server, cancel, stopped, *shutdownDrain, shutdownTimeout)
+}
+
+// shutdown stops being ready and keeps serving during the drain period, stops
+// the HTTP server once the requests in progress are answered, then aborts the
+// scrapes and waits for the cluster workers. It returns false when they didn't
+// stop within the timeout.
+func shutdown(server *http.Server, cancel context.CancelFunc, stopped <-chan struct{}, drain time.Duration, timeout time.Duration) bool {
+	atomic.StoreInt32(&shuttingDown, 1)
+	if drain > 0 {
+		log.Printf("Not ready anymore, draining for %s\n", drain)
+		time.Sleep(drain)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down the HTTP server: %s\n", err.Error())
+	}
+	// Abort the scrapes in progress and wait for the cluster workers
+	cancel()
+	select {
+	case <-stopped:
+		log.Printf("Shutdown complete\n")
+		return true
+	case <-shutdownCtx.Done():
+		log.Printf("Cluster monitors didn't stop within %s\n", timeout)
+		return false
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/elfido/n1qlExporter/datamonitor"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesOf returns the label values of every series of a vector, by label name
+func seriesOf(vector prometheus.Collector) []map[string]string {
+	metrics := make(chan prometheus.Metric, 100)
+	vector.Collect(metrics)
+	close(metrics)
+	series := []map[string]string{}
+	for metric := range metrics {
+		var written dto.Metric
+		metric.Write(&written)
+		labels := make(map[string]string)
+		for _, pair := range written.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		series = append(series, labels)
+	}
+	return series
+}
+
+func TestReportClusterMetricsGroupChange(t *testing.T) {
+	defer forgetCluster("MOVED")
+	status := func(group string) *datamonitor.ClusterStatus {
+		return &datamonitor.ClusterStatus{
+			ClusterName:  "MOVED",
+			Nodes:        []datamonitor.NodeStatus{{Node: "n1", Status: "healthy", CPUCount: 4}},
+			ServerGroups: map[string]string{"n1": group},
+		}
+	}
+	reportClusterMetrics(status("g1"))
+	scrapeMetrics.activeOldest.WithLabelValues("MOVED", "n1", "g1").Set(10)
+	reportClusterMetrics(status("g2"))
+	for _, vector := range []prometheus.Collector{nodeCPUCount, nodeStatus, nodeInfo, scrapeMetrics.activeOldest} {
+		for _, labels := range seriesOf(vector) {
+			if labels["cluster"] == "MOVED" && labels["server_group"] != "g2" {
+				t.Errorf("Expected only series in the new group, found %v", labels)
+			}
+		}
+	}
+	found := 0
+	for _, labels := range seriesOf(nodeCPUCount) {
+		if labels["cluster"] == "MOVED" {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("Expected the node once, found %d series", found)
+	}
+}
@@ -1,121 +1,438 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"runtime"
+
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 // metrics
 
-// Active queries
-var activeExecutionTime = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_active_time_execution",
-		Help:    "N1QL Current queries execution time",
-		Buckets: prometheus.ExponentialBuckets(1, 2, 17),
-	},
-	[]string{"cluster", "node", "query_type"},
-)
+// queryMetrics Metrics of the query service, the scrape loop exports
+// scrapeMetrics and every probed cluster keeps its own so /probe exports the
+// same families
+type queryMetrics struct {
+	// Histograms are built once the configured buckets are known
+	activeExecutionTime    *prometheus.HistogramVec
+	activeAccumulation     *prometheus.HistogramVec
+	activeWaitingTime      *prometheus.HistogramVec
+	completedResultCount   *prometheus.HistogramVec
+	completedResultSize    *prometheus.HistogramVec
+	completedExecutionTime *prometheus.HistogramVec
+	completedWaitingTime   *prometheus.HistogramVec
 
-var activeAccumulation = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_active_accumulated_queries",
-		Help:    "N1QL Current queries in execution",
-		Buckets: []float64{0, 10, 20, 50, 100, 250, 1000, 5000, 10000},
-	},
-	[]string{"cluster", "node"},
-)
+	// Latency histograms in milliseconds under their former names, only with
+	// -histograms.legacy-metrics
+	legacyActiveExecutionTime    *prometheus.HistogramVec
+	legacyActiveWaitingTime      *prometheus.HistogramVec
+	legacyCompletedExecutionTime *prometheus.HistogramVec
+	legacyCompletedWaitingTime   *prometheus.HistogramVec
 
-var activeWaitingTime = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_active_time_waiting",
-		Help:    "N1QL Current queries waiting time",
-		Buckets: prometheus.ExponentialBuckets(1, 2, 17),
-	},
-	[]string{"cluster", "node", "query_type"},
-)
+	// Active queries
+	activeScanConsistency *prometheus.CounterVec
+	activeQueries         *prometheus.GaugeVec
+	activeOldest          *prometheus.GaugeVec
+	activeOverThreshold   *prometheus.GaugeVec
+	cancelledQueries      *prometheus.CounterVec
 
-var activeScanConsistency = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name: "n1ql_active_consistency",
-		Help: "N1QL Current queries waiting time",
-	},
-	[]string{"cluster", "consistency"},
-)
+	// Completed queries
+	completedPrimaryIndexUse *prometheus.CounterVec
+	completedOverflows       *prometheus.CounterVec
+	completedLost            *prometheus.CounterVec
 
-// Completed queries
-var completedResultCount = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_completed_result_count",
-		Help:    "N1QL Number of results per query",
-		Buckets: []float64{0, 10, 20, 50, 100, 250, 500, 1000, 5000, 10000, 100000, 500000, 1000000},
-	},
-	[]string{"cluster", "query_type"},
-)
+	// Vitals
+	completedVitals *prometheus.GaugeVec
+	cpuVitals       *prometheus.GaugeVec
+
+	// Prepared statements
+	preparedCacheSize      *prometheus.GaugeVec
+	preparedUses           *prometheus.GaugeVec
+	preparedAvgServiceTime *prometheus.GaugeVec
+	preparedEvictions      *prometheus.CounterVec
+	preparedReprepares     *prometheus.CounterVec
+
+	// Settings
+	querySettings             *prometheus.GaugeVec
+	querySettingsDrift        *prometheus.GaugeVec
+	completedSettingsInEffect *prometheus.GaugeVec
+
+	scrapeTimeouts *prometheus.CounterVec
+	vitals         *vitalsCollector
+	quantiles      *quantilesCollector
+
+	// reportedActive keeps the labels of n1ql_active_queries exported per
+	// cluster and node so combinations without active queries go back to zero
+	reportedActive map[string]map[string]map[string]activeCombination
+	// reportedPrepareds keeps the labels of the prepared statements exported
+	// per cluster and node so statements leaving the top N are removed
+	reportedPrepareds map[string]map[string][][]string
+}
+
+// scrapeMetrics Query service metrics of the monitored clusters
+var scrapeMetrics = newQueryMetrics()
+
+// newQueryMetrics creates the query service metrics, the histograms are built
+// apart since their buckets are configured
+func newQueryMetrics() *queryMetrics {
+	return &queryMetrics{
+		activeScanConsistency: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_active_consistency",
+				Help: "N1QL Current queries waiting time",
+			},
+			[]string{"cluster", "consistency"},
+		),
+		activeQueries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_active_queries",
+				Help: "N1QL queries active at the last scrape",
+			},
+			[]string{"cluster", "node", "server_group", "query_type", "scan_consistency", "state"},
+		),
+		activeOldest: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_active_oldest_query_seconds",
+				Help: "N1QL elapsed time of the oldest active query",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		activeOverThreshold: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_active_queries_over_threshold",
+				Help: "N1QL active queries running longer than the threshold (seconds)",
+			},
+			[]string{"cluster", "node", "server_group", "threshold"},
+		),
+		cancelledQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_cancelled_queries_total",
+				Help: "N1QL active queries cancelled by the cancel policy per rule and result (cancelled, dry_run or error)",
+			},
+			[]string{"cluster", "node", "server_group", "rule", "result"},
+		),
+		completedPrimaryIndexUse: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_completed_primaryindex",
+				Help: "N1QL Current queries waiting time",
+			},
+			[]string{"cluster", "query_type"},
+		),
+		completedOverflows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_completed_buffer_overflow_total",
+				Help: "N1QL times the completed requests buffer wrapped between scrapes, losing requests",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		completedLost: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_completed_lost_requests_total",
+				Help: "N1QL estimated completed requests lost because the completed requests buffer wrapped",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		completedVitals: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_vitals_completed_queries",
+				Help: "N1QL completed queries from vitals",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		cpuVitals: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_vitals_cpu_usage",
+				Help: "N1QL CPU usage for user/system",
+			},
+			[]string{"cluster", "node", "server_group", "space"},
+		),
+		preparedCacheSize: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_prepared_cache_size",
+				Help: "N1QL prepared statements in cache",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		preparedUses: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_prepared_uses",
+				Help: "N1QL executions of the most used prepared statements",
+			},
+			[]string{"cluster", "node", "server_group", "name"},
+		),
+		preparedAvgServiceTime: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_prepared_avg_service_time_seconds",
+				Help: "N1QL average service time of the most used prepared statements",
+			},
+			[]string{"cluster", "node", "server_group", "name"},
+		),
+		preparedEvictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_prepared_evictions_total",
+				Help: "N1QL prepared statements evicted from cache, computed across scrapes",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		preparedReprepares: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_prepared_reprepares_total",
+				Help: "N1QL prepared statements prepared again after an eviction, computed across scrapes",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		querySettings: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_settings",
+				Help: "N1QL numeric query node settings (completed-threshold, completed-limit, max-parallelism, ...)",
+			},
+			[]string{"cluster", "node", "server_group", "setting"},
+		),
+		querySettingsDrift: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_settings_drift",
+				Help: "N1QL query node setting differs (1) or not (0) from the value in most nodes of the cluster",
+			},
+			[]string{"cluster", "node", "server_group", "setting"},
+		),
+		completedSettingsInEffect: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "n1ql_completed_settings_in_effect",
+				Help: "N1QL completed requests settings managed by the exporter are in effect (1) or not (0)",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		scrapeTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "n1ql_exporter_scrape_timeouts_total",
+				Help: "N1QL exporter scrapes of a query node that didn't answer within the scrape timeout",
+			},
+			[]string{"cluster", "node", "server_group"},
+		),
+		vitals: &vitalsCollector{
+			nodes: make(map[string]map[string]nodeVitals),
+		},
+		quantiles: &quantilesCollector{
+			clusters: make(map[string][]n1qlmonitor.QuantileSummary),
+		},
+		reportedActive:    make(map[string]map[string]map[string]activeCombination),
+		reportedPrepareds: make(map[string]map[string][][]string),
+	}
+}
+
+// vectors returns the metric vectors, the histograms only once they are built
+func (m *queryMetrics) vectors() []clusterVector {
+	vectors := []clusterVector{
+		m.activeScanConsistency, m.activeQueries, m.activeOldest, m.activeOverThreshold, m.cancelledQueries,
+		m.completedPrimaryIndexUse, m.completedOverflows, m.completedLost, m.completedVitals, m.cpuVitals,
+		m.preparedCacheSize, m.preparedUses, m.preparedAvgServiceTime, m.preparedEvictions, m.preparedReprepares,
+		m.querySettings, m.querySettingsDrift, m.completedSettingsInEffect, m.scrapeTimeouts,
+	}
+	for _, histogram := range []*prometheus.HistogramVec{
+		m.activeExecutionTime, m.activeAccumulation, m.activeWaitingTime, m.completedResultCount, m.completedResultSize, m.completedExecutionTime, m.completedWaitingTime,
+		m.legacyActiveExecutionTime, m.legacyActiveWaitingTime, m.legacyCompletedExecutionTime, m.legacyCompletedWaitingTime,
+	} {
+		if histogram != nil {
+			vectors = append(vectors, histogram)
+		}
+	}
+	return vectors
+}
 
-var completedResultSize = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_completed_result_size",
-		Help:    "N1QL Response size in bytes",
-		Buckets: prometheus.ExponentialBuckets(200, 2.5, 15),
+// forgetNode deletes the series of a node that left the cluster or moved to
+// another server group, they are labeled with its previous group
+func (m *queryMetrics) forgetNode(clusterName string, node string, group string) {
+	for _, vector := range m.vectors() {
+		deleteSeries(vector, prometheus.Labels{"cluster": clusterName, "node": node, "server_group": group})
+	}
+	delete(m.reportedActive[clusterName], node)
+	delete(m.reportedPrepareds[clusterName], node)
+}
+
+// forget drops what is kept of a cluster that is not monitored anymore
+func (m *queryMetrics) forget(clusterName string) {
+	delete(m.reportedActive, clusterName)
+	delete(m.reportedPrepareds, clusterName)
+	m.vitals.forget(clusterName)
+	m.quantiles.forget(clusterName)
+}
+
+// Exporter
+var scrapeIntervalSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "n1ql_exporter_scrape_interval_seconds",
+		Help: "N1QL exporter current scrape interval of a cluster",
 	},
-	[]string{"cluster", "query_type"},
+	[]string{"cluster"},
 )
 
-var completedExecutionTime = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_completed_time_execution",
-		Help:    "N1QL Current queries execution time",
-		Buckets: prometheus.ExponentialBuckets(1, 2, 17),
+var scrapeDuration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "n1ql_exporter_scrape_duration_seconds",
+		Help: "N1QL exporter duration of the last scrape of a cluster",
 	},
-	[]string{"cluster", "node", "query_type", "state"},
+	[]string{"cluster"},
 )
 
-var completedWaitingTime = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "n1ql_completed_time_waiting",
-		Help:    "N1QL Completed queries waiting time",
-		Buckets: prometheus.ExponentialBuckets(1, 2, 17),
+var relabelCollisions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "n1ql_exporter_relabel_collisions_total",
+		Help: "N1QL exporter series dropped because the relabeling rules made them identical to another series",
 	},
-	[]string{"cluster", "node", "query_type"},
+	[]string{"cluster"},
 )
 
-var completedPrimaryIndexUse = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name: "n1ql_completed_primaryindex",
-		Help: "N1QL Current queries waiting time",
+var configReloadSuccess = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "n1ql_exporter_config_last_reload_successful",
+		Help: "N1QL exporter last configuration reload succeeded (1) or not (0)",
 	},
-	[]string{"cluster", "query_type"},
 )
 
-// Vitals
-var completedVitals = prometheus.NewGaugeVec(
+var configReloadTime = prometheus.NewGauge(
 	prometheus.GaugeOpts{
-		Name: "n1ql_vitals_completed_queries",
-		Help: "N1QL completed queries from vitals",
+		Name: "n1ql_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "N1QL exporter timestamp of the last successful configuration reload",
 	},
-	[]string{"cluster", "node"},
 )
 
-var cpuVitals = prometheus.NewGaugeVec(
+var buildInfo = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
-		Name: "n1ql_vitals_cpu_usage",
-		Help: "N1QL CPU usage for user/system",
+		Name: "n1ql_exporter_build_info",
+		Help: "N1QL exporter version and Go version used to build it, always 1",
 	},
-	[]string{"cluster", "node", "space"},
+	[]string{"version", "goversion"},
 )
 
+// initLegacyActiveMetrics registers the active queries metrics replaced by
+// n1ql_active_queries, kept for existing dashboards
+func initLegacyActiveMetrics() {
+	registerMetrics(
+		scrapeMetrics.activeAccumulation,
+		scrapeMetrics.activeScanConsistency,
+	)
+}
+
+// initLegacyHistogramMetrics builds and registers the latency histograms in
+// milliseconds replaced by the *_seconds ones, kept for existing dashboards
+func initLegacyHistogramMetrics() {
+	scrapeMetrics.buildLegacyHistograms()
+	registerMetrics(
+		scrapeMetrics.legacyActiveExecutionTime,
+		scrapeMetrics.legacyActiveWaitingTime,
+		scrapeMetrics.legacyCompletedExecutionTime,
+		scrapeMetrics.legacyCompletedWaitingTime,
+	)
+}
+
+// buildLegacyHistograms builds the latency histograms in milliseconds, their
+// buckets are not configurable
+func (m *queryMetrics) buildLegacyHistograms() {
+	buckets := prometheus.ExponentialBuckets(1, 2, 17)
+	newLegacy := func(name string, help string, labels []string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	}
+	m.legacyActiveExecutionTime = newLegacy("n1ql_active_time_execution",
+		"N1QL Current queries execution time in milliseconds, deprecated by n1ql_active_time_execution_seconds",
+		[]string{"cluster", "node", "server_group", "query_type"})
+	m.legacyActiveWaitingTime = newLegacy("n1ql_active_time_waiting",
+		"N1QL Current queries waiting time in milliseconds, deprecated by n1ql_active_time_waiting_seconds",
+		[]string{"cluster", "node", "server_group", "query_type"})
+	m.legacyCompletedExecutionTime = newLegacy("n1ql_completed_time_execution",
+		"N1QL Completed queries execution time in milliseconds, deprecated by n1ql_completed_time_execution_seconds",
+		[]string{"cluster", "node", "server_group", "query_type", "state"})
+	m.legacyCompletedWaitingTime = newLegacy("n1ql_completed_time_waiting",
+		"N1QL Completed queries waiting time in milliseconds, deprecated by n1ql_completed_time_waiting_seconds",
+		[]string{"cluster", "node", "server_group", "query_type"})
+}
+
+// histogramsInUse Buckets settings the histograms were built with, they are
+// only read on startup
+var histogramsInUse histogramSettings
+
+// initHistogramMetrics builds and registers the histograms with the configured
+// buckets
+func initHistogramMetrics(settings histogramSettings) {
+	histogramsInUse = settings
+	scrapeMetrics.buildHistograms(settings)
+	checkHistogramSettings(settings, []string{
+		"n1ql_active_time_execution_seconds",
+		"n1ql_active_accumulated_queries",
+		"n1ql_active_time_waiting_seconds",
+		"n1ql_completed_result_count",
+		"n1ql_completed_result_size",
+		"n1ql_completed_time_execution_seconds",
+		"n1ql_completed_time_waiting_seconds",
+	})
+	registerMetrics(
+		scrapeMetrics.activeExecutionTime,
+		scrapeMetrics.activeWaitingTime,
+		scrapeMetrics.completedResultCount,
+		scrapeMetrics.completedResultSize,
+		scrapeMetrics.completedExecutionTime,
+		scrapeMetrics.completedWaitingTime,
+	)
+}
+
+// buildHistograms builds the histograms with the configured buckets,
+// latencies are in seconds
+func (m *queryMetrics) buildHistograms(settings histogramSettings) {
+	latencyBuckets := prometheus.ExponentialBuckets(0.001, 2, 17)
+	m.activeExecutionTime = newHistogramVec(settings, "n1ql_active_time_execution_seconds",
+		"N1QL Current queries execution time", latencyBuckets,
+		[]string{"cluster", "node", "server_group", "query_type"})
+	m.activeAccumulation = newHistogramVec(settings, "n1ql_active_accumulated_queries",
+		"N1QL Current queries in execution", []float64{0, 10, 20, 50, 100, 250, 1000, 5000, 10000},
+		[]string{"cluster", "node", "server_group"})
+	m.activeWaitingTime = newHistogramVec(settings, "n1ql_active_time_waiting_seconds",
+		"N1QL Current queries waiting time", latencyBuckets,
+		[]string{"cluster", "node", "server_group", "query_type"})
+	m.completedResultCount = newHistogramVec(settings, "n1ql_completed_result_count",
+		"N1QL Number of results per query", []float64{0, 10, 20, 50, 100, 250, 500, 1000, 5000, 10000, 100000, 500000, 1000000},
+		[]string{"cluster", "query_type"})
+	m.completedResultSize = newHistogramVec(settings, "n1ql_completed_result_size",
+		"N1QL Response size in bytes", prometheus.ExponentialBuckets(200, 2.5, 15),
+		[]string{"cluster", "query_type"})
+	m.completedExecutionTime = newHistogramVec(settings, "n1ql_completed_time_execution_seconds",
+		"N1QL Completed queries execution time", latencyBuckets,
+		[]string{"cluster", "node", "server_group", "query_type", "state"})
+	m.completedWaitingTime = newHistogramVec(settings, "n1ql_completed_time_waiting_seconds",
+		"N1QL Completed queries waiting time", latencyBuckets,
+		[]string{"cluster", "node", "server_group", "query_type"})
+}
+
 func initN1QLMetrics() {
-	prometheus.MustRegister(
-		activeExecutionTime,
-		activeAccumulation,
-		activeWaitingTime,
-		activeScanConsistency,
+	m := scrapeMetrics
+	registerMetrics(
+		m.activeQueries,
+		m.activeOldest,
+		m.activeOverThreshold,
+		m.cancelledQueries,
 		// Completed queries
-		completedResultCount,
-		completedResultSize,
-		completedExecutionTime,
-		completedWaitingTime,
-		completedPrimaryIndexUse,
+		m.completedPrimaryIndexUse,
+		m.completedOverflows,
+		m.completedLost,
 		// Vitals
-		completedVitals,
-		cpuVitals,
+		m.completedVitals,
+		m.cpuVitals,
+		// Prepared statements
+		m.preparedCacheSize,
+		m.preparedUses,
+		m.preparedAvgServiceTime,
+		m.preparedEvictions,
+		m.preparedReprepares,
+		// Settings
+		m.querySettings,
+		m.querySettingsDrift,
+		m.completedSettingsInEffect,
+		// Exporter
+		scrapeIntervalSeconds,
+		scrapeDuration,
+		m.scrapeTimeouts,
+		relabelCollisions,
+		configReloadSuccess,
+		configReloadTime,
+		buildInfo,
 	)
+	buildInfo.WithLabelValues(exporterVersion, runtime.Version()).Set(1)
 }
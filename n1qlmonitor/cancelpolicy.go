@@ -0,0 +1,245 @@
+package n1qlmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+)
+
+// CancelRule Conditions an active query must match to be cancelled, every
+// condition set has to match and the elapsed time limit is mandatory
+type CancelRule struct {
+	Name        string `json:"name"`
+	MaxElapsed  string `json:"maxelapsed"`  // Duration, e.g. 10m
+	Fingerprint string `json:"fingerprint"` // Exact statement fingerprint
+	Users       string `json:"users"`       // Regular expression
+	Statement   string `json:"statement"`   // Regular expression over the normalized statement
+	PrimaryScan bool   `json:"primaryscan"` // Only queries using a primary scan
+}
+
+// CancelPolicy Rules to cancel runaway queries, disabled unless Enabled is set
+type CancelPolicy struct {
+	Enabled bool         `json:"enabled"`
+	DryRun  bool         `json:"dryrun"`
+	Rules   []CancelRule `json:"rules"`
+}
+
+// Cancellation Active query cancelled by a rule
+type Cancellation struct {
+	Rule   string
+	DryRun bool
+	Query  RunawayQuery
+	Error  error
+}
+
+type cancelRule struct {
+	name        string
+	maxElapsed  time.Duration
+	fingerprint string
+	users       *regexp.Regexp
+	statement   *regexp.Regexp
+	primaryScan bool
+}
+
+type cancelPolicy struct {
+	dryRun    bool
+	rules     []cancelRule
+	mutex     sync.Mutex
+	cancelled map[string]map[string]bool // node -> requestID cancelled or being cancelled
+	finished  map[string][]Cancellation  // node -> cancellations completed since the last scrape
+	running   sync.WaitGroup             // Cancellations in progress
+}
+
+// adminTimeout bounds every cancellation and settings update, they run
+// outside the scrape so they don't use up the time given to the nodes to answer
+const adminTimeout = 10 * time.Second
+
+func compileCancelRule(rule CancelRule) (cancelRule, error) {
+	compiled := cancelRule{
+		name:        rule.Name,
+		fingerprint: rule.Fingerprint,
+		primaryScan: rule.PrimaryScan,
+	}
+	if rule.MaxElapsed == "" {
+		return compiled, fmt.Errorf("rule %s has no maxelapsed", rule.Name)
+	}
+	maxElapsed, err := time.ParseDuration(rule.MaxElapsed)
+	if err != nil {
+		return compiled, fmt.Errorf("rule %s: %s", rule.Name, err.Error())
+	}
+	compiled.maxElapsed = maxElapsed
+	if rule.Users != "" {
+		compiled.users, err = regexp.Compile(rule.Users)
+		if err != nil {
+			return compiled, fmt.Errorf("rule %s: %s", rule.Name, err.Error())
+		}
+	}
+	if rule.Statement != "" {
+		compiled.statement, err = regexp.Compile(rule.Statement)
+		if err != nil {
+			return compiled, fmt.Errorf("rule %s: %s", rule.Name, err.Error())
+		}
+	}
+	return compiled, nil
+}
+
+func (rule *cancelRule) matches(query *activeQueryResponse) bool {
+	if time.Duration(query.ElapsedTime)*time.Millisecond < rule.maxElapsed {
+		return false
+	}
+	if rule.fingerprint != "" && rule.fingerprint != query.Fingerprint {
+		return false
+	}
+	if rule.users != nil && !rule.users.MatchString(query.Users) {
+		return false
+	}
+	if rule.statement != nil && !rule.statement.MatchString(query.NormalizedStatement) {
+		return false
+	}
+	if rule.primaryScan && query.PhaseCounts.PrimaryScan == 0 {
+		return false
+	}
+	return true
+}
+
+// Validate checks every rule of the policy, even when it is disabled
+func (policy CancelPolicy) Validate() error {
+	for _, rule := range policy.Rules {
+		if _, err := compileCancelRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCancelPolicy enables the cancellation of the active queries matching the
+// policy rules, nothing is cancelled unless the policy is enabled
+func (m *Monitor) SetCancelPolicy(policy CancelPolicy) error {
+	if !policy.Enabled {
+		m.cancelPolicy = nil
+		return nil
+	}
+	compiled := &cancelPolicy{
+		dryRun:    policy.DryRun,
+		rules:     make([]cancelRule, 0, len(policy.Rules)),
+		cancelled: make(map[string]map[string]bool),
+		finished:  make(map[string][]Cancellation),
+	}
+	for _, rule := range policy.Rules {
+		cancel, err := compileCancelRule(rule)
+		if err != nil {
+			return err
+		}
+		compiled.rules = append(compiled.rules, cancel)
+	}
+	m.cancelPolicy = compiled
+	return nil
+}
+
+func cancelQuery(ctx context.Context, server string, serverAuth *cbapi.Auth, requestID string) error {
+	return cbapi.DeleteAPI(ctx, server+"/admin/active_requests/"+url.PathEscape(requestID), serverAuth)
+}
+
+// auditCancellation writes a JSON event for every cancellation, including dry runs
+func auditCancellation(clusterName string, cancellation Cancellation) {
+	result := "cancelled"
+	if cancellation.DryRun {
+		result = "dry_run"
+	}
+	if cancellation.Error != nil {
+		result = "error: " + cancellation.Error.Error()
+	}
+	event, _ := json.Marshal(map[string]interface{}{
+		"event":           "query_cancellation",
+		"cluster":         clusterName,
+		"node":            cancellation.Query.Node,
+		"rule":            cancellation.Rule,
+		"result":          result,
+		"requestID":       cancellation.Query.RequestID,
+		"elapsed":         cancellation.Query.Elapsed.Seconds(),
+		"fingerprint":     cancellation.Query.Fingerprint,
+		"statement":       cancellation.Query.Statement,
+		"users":           cancellation.Query.Users,
+		"clientContextID": cancellation.Query.ClientContextID,
+	})
+	log.Println(string(event))
+}
+
+// enforceCancelPolicy cancels the active queries of a node matching a rule in
+// the background, the cancellations completed since the previous scrape are
+// reported with this one. A request whose cancellation failed is evaluated
+// again on the next scrape and cancelled again if it still matches.
+func (m *Monitor) enforceCancelPolicy(ctx context.Context, server *ServerResponse) {
+	policy := m.cancelPolicy
+	if policy == nil {
+		return
+	}
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	server.Cancellations = append(server.Cancellations, policy.finished[server.Node]...)
+	delete(policy.finished, server.Node)
+	handled := policy.cancelled[server.Node]
+	current := make(map[string]bool)
+	for ndx := range server.Active {
+		query := &server.Active[ndx]
+		if query.RequestID == "" {
+			continue
+		}
+		if handled[query.RequestID] {
+			current[query.RequestID] = true
+			continue
+		}
+		for _, rule := range policy.rules {
+			if !rule.matches(query) {
+				continue
+			}
+			cancellation := Cancellation{
+				Rule:   rule.name,
+				DryRun: policy.dryRun,
+				Query: RunawayQuery{
+					RequestID:       query.RequestID,
+					Node:            server.Node,
+					Fingerprint:     query.Fingerprint,
+					Statement:       query.NormalizedStatement,
+					Users:           query.Users,
+					ClientContextID: query.ClientContextID,
+					Elapsed:         time.Duration(query.ElapsedTime) * time.Millisecond,
+				},
+			}
+			current[query.RequestID] = true
+			if policy.dryRun {
+				auditCancellation(m.ClusterName, cancellation)
+				server.Cancellations = append(server.Cancellations, cancellation)
+			} else {
+				policy.running.Add(1)
+				go policy.cancel(ctx, m.ClusterName, m.protocol+"://"+server.Node+":8093", &m.HTTPAuth, cancellation)
+			}
+			break
+		}
+	}
+	policy.cancelled[server.Node] = current
+}
+
+// cancel cancels a query and keeps the result for the next scrape of its
+// node, the request is forgotten when it failed so it is retried
+func (policy *cancelPolicy) cancel(ctx context.Context, clusterName string, server string, serverAuth *cbapi.Auth, cancellation Cancellation) {
+	defer policy.running.Done()
+	cancelCtx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+	cancellation.Error = cancelQuery(cancelCtx, server, serverAuth, cancellation.Query.RequestID)
+	auditCancellation(clusterName, cancellation)
+	node := cancellation.Query.Node
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	policy.finished[node] = append(policy.finished[node], cancellation)
+	if cancellation.Error != nil {
+		delete(policy.cancelled[node], cancellation.Query.RequestID)
+	}
+}
@@ -0,0 +1,119 @@
+package n1qlmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+)
+
+// CompletedSettings Completed requests settings asserted on every query node
+type CompletedSettings struct {
+	Threshold  *int64                 `json:"threshold"` // milliseconds, 0 logs every request and -1 disables logging
+	Limit      *int64                 `json:"limit"`
+	Qualifiers map[string]interface{} `json:"qualifiers"` // 6.5+ only: aborted, error, user, client, context
+}
+
+// ManageCompletedSettings makes the monitor assert the completed requests
+// settings on every query node, including nodes added later
+func (m *Monitor) ManageCompletedSettings(settings CompletedSettings) {
+	m.completedSettings = &settings
+	m.completedApplied = make(map[string]bool)
+}
+
+// inEffect checks the settings read from the node against the desired ones
+func (settings *CompletedSettings) inEffect(server *ServerResponse) bool {
+	if !server.SettingsCollected {
+		return false
+	}
+	if settings.Threshold != nil && server.Settings["completed-threshold"] != float64(*settings.Threshold) {
+		return false
+	}
+	if settings.Limit != nil && server.Settings["completed-limit"] != float64(*settings.Limit) {
+		return false
+	}
+	return settings.qualifiersInEffect(server.completedQualifiers)
+}
+
+// qualifiersInEffect checks the qualifiers reported by the node: flags like
+// aborted only have to be present, values like error or user have to match
+func (settings *CompletedSettings) qualifiersInEffect(reported map[string]interface{}) bool {
+	for name, value := range settings.Qualifiers {
+		current, found := reported[name]
+		if !found {
+			return false
+		}
+		switch value.(type) {
+		case nil, bool:
+			continue
+		}
+		expected, _ := json.Marshal(value)
+		actual, _ := json.Marshal(current)
+		if !bytes.Equal(expected, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+func (settings *CompletedSettings) body() ([]byte, error) {
+	body := make(map[string]interface{})
+	if settings.Threshold != nil {
+		body["completed-threshold"] = *settings.Threshold
+	}
+	if settings.Limit != nil {
+		body["completed-limit"] = *settings.Limit
+	}
+	if len(settings.Qualifiers) > 0 {
+		body["completed"] = settings.Qualifiers
+	}
+	return json.Marshal(body)
+}
+
+func applyCompletedSettings(ctx context.Context, server string, serverAuth *cbapi.Auth, settings *CompletedSettings) error {
+	body, err := settings.body()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+	_, err = cbapi.PostAPI(ctx, server+"/admin/settings", serverAuth, "application/json", body)
+	return err
+}
+
+// enforceCompletedSettings applies the completed settings to the nodes that
+// don't have them yet (new or restarted nodes, or changed by someone else)
+func (m *Monitor) enforceCompletedSettings(ctx context.Context, servers []ServerResponse) {
+	if m.completedSettings == nil {
+		return
+	}
+	for ndx := range servers {
+		server := &servers[ndx]
+		if server.TimedOut {
+			continue
+		}
+		server.CompletedSettingsManaged = true
+		inEffect := m.completedSettings.inEffect(server)
+		if inEffect && m.completedApplied[server.Node] {
+			server.CompletedSettingsInEffect = true
+			continue
+		}
+		if !server.SettingsCollected && m.completedApplied[server.Node] {
+			// Settings could not be read, keep the last known state
+			server.CompletedSettingsInEffect = true
+			continue
+		}
+		url := m.protocol + "://" + server.Node + ":8093"
+		err := applyCompletedSettings(ctx, url, &m.HTTPAuth, m.completedSettings)
+		if err != nil {
+			log.Printf("Cannot apply completed settings to %s in cluster %s: %s\n", server.Node, m.ClusterName, err.Error())
+			m.completedApplied[server.Node] = false
+			continue
+		}
+		log.Printf("Applied completed settings to %s in cluster %s\n", server.Node, m.ClusterName)
+		m.completedApplied[server.Node] = true
+		server.CompletedSettingsInEffect = true
+	}
+}
@@ -0,0 +1,112 @@
+package n1qlmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunawayQuery Active query that crossed a long running threshold
+type RunawayQuery struct {
+	RequestID       string
+	Node            string
+	Fingerprint     string
+	Statement       string // Normalized, literals replaced by ?
+	Users           string
+	ClientContextID string
+	Elapsed         time.Duration
+	Threshold       time.Duration
+}
+
+var literalPattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|\b\d+(?:\.\d+)?\b`)
+var spacePattern = regexp.MustCompile(`\s+`)
+
+// normalizeStatement replaces literals by ? and collapses blanks so the same
+// query with different values has the same text
+func normalizeStatement(statement string) string {
+	normalized := literalPattern.ReplaceAllString(statement, "?")
+	return spacePattern.ReplaceAllString(strings.TrimSpace(normalized), " ")
+}
+
+// fingerprint identifies a normalized statement
+func fingerprint(normalized string) string {
+	if normalized == "" {
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(normalized))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// parseUsers reads the users of a request, reported either as a string or a list
+func parseUsers(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var users string
+	if json.Unmarshal(raw, &users) == nil {
+		return users
+	}
+	var userList []string
+	if json.Unmarshal(raw, &userList) == nil {
+		return strings.Join(userList, ",")
+	}
+	return string(raw)
+}
+
+// SetLongRunningThresholds sets the elapsed times from which an active query is
+// considered long running
+func (m *Monitor) SetLongRunningThresholds(thresholds []time.Duration) {
+	m.longRunning = append([]time.Duration{}, thresholds...)
+	sort.Slice(m.longRunning, func(i, j int) bool {
+		return m.longRunning[i] < m.longRunning[j]
+	})
+}
+
+// trackActive follows the active requests of a node by requestID, counting the
+// queries over each threshold and reporting every query the first time it
+// crosses each of them. Requests no longer active are forgotten.
+func (m *Monitor) trackActive(server *ServerResponse) {
+	previous := m.activeReported[server.Node]
+	current := make(map[string]int)
+	server.ActiveOverThreshold = make([]int, len(m.longRunning), len(m.longRunning))
+	for _, query := range server.Active {
+		elapsed := time.Duration(query.ElapsedTime) * time.Millisecond
+		if elapsed.Seconds() > server.OldestActive {
+			server.OldestActive = elapsed.Seconds()
+		}
+		crossed := 0
+		for ndx, threshold := range m.longRunning {
+			if elapsed >= threshold {
+				server.ActiveOverThreshold[ndx]++
+				crossed = ndx + 1
+			}
+		}
+		if query.RequestID == "" {
+			continue
+		}
+		for ndx := previous[query.RequestID]; ndx < crossed; ndx++ {
+			server.Runaways = append(server.Runaways, RunawayQuery{
+				RequestID:       query.RequestID,
+				Node:            server.Node,
+				Fingerprint:     query.Fingerprint,
+				Statement:       query.NormalizedStatement,
+				Users:           query.Users,
+				ClientContextID: query.ClientContextID,
+				Elapsed:         elapsed,
+				Threshold:       m.longRunning[ndx],
+			})
+		}
+		if previous[query.RequestID] > crossed {
+			crossed = previous[query.RequestID]
+		}
+		if crossed > 0 {
+			current[query.RequestID] = crossed
+		}
+	}
+	m.activeReported[server.Node] = current
+}
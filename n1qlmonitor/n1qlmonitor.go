@@ -1,9 +1,10 @@
 package n1qlmonitor
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,10 +16,37 @@ type Monitor struct {
 	ClusterName       string
 	Servers           []string
 	HTTPAuth          cbapi.Auth
-	lastRecordedQuery time.Time
+	lastRecorded      map[string]time.Time // node -> request time of the last completed request read
 	scrapCount        int64
 	protocol          string
 	datelayout        string
+	preparedUses      map[string]map[string]int64 // node -> prepared name -> uses
+	preparedEvicted   map[string]map[string]bool  // node -> evicted prepared names
+	completedSettings *CompletedSettings
+	completedApplied  map[string]bool
+	longRunning       []time.Duration           // Sorted long running thresholds
+	activeReported    map[string]map[string]int // node -> requestID -> thresholds already reported
+	cancelPolicy      *cancelPolicy
+	quantiles         *quantileTracker
+	timeout           time.Duration // Nodes not answering within it are reported as timed out, 0 waits for every node
+	concurrency       int           // Nodes scraped at once, 0 scrapes every node at once
+}
+
+// maxEvictedPrepareds bounds the evicted names remembered per node, anonymous
+// prepared statements get a new name every time so the set can grow forever
+const maxEvictedPrepareds = 10000
+
+// PreparedStatement Prepared statements cache entry
+type PreparedStatement struct {
+	Name           string
+	Uses           int64
+	AvgServiceTime float64 // seconds
+}
+
+type preparedResponse struct {
+	Name           string `json:"name"`
+	Uses           int64  `json:"uses"`
+	AvgServiceTime string `json:"avgServiceTime"`
 }
 
 type completedQueryResponse struct {
@@ -51,42 +79,159 @@ type completedQueryResponse struct {
 
 // ActiveQueryResponse from Couchbase
 type activeQueryResponse struct {
-	ElapsedTimeString   string `json:"elapsedTime"`
-	ExecutionTimeString string `json:"executionTime"`
-	ScanConsistency     string `json:"scanConsistency"`
-	Statement           string `json:"statement"`
+	RequestID           string          `json:"requestId"`
+	ClientContextID     string          `json:"clientContextID"`
+	UsersRaw            json.RawMessage `json:"users"`
+	ElapsedTimeString   string          `json:"elapsedTime"`
+	ExecutionTimeString string          `json:"executionTime"`
+	ScanConsistency     string          `json:"scanConsistency"`
+	State               string          `json:"state"`
+	Statement           string          `json:"statement"`
+	PhaseCounts         struct {
+		PrimaryScan int `json:"primaryScan"`
+	} `json:"phaseCounts"`
 	ElapsedTime         int64
 	ExecutionTime       int64
 	WaitingTime         int64
 	QueryType           string
+	Users               string
+	Fingerprint         string
+	NormalizedStatement string
 }
 
 type completedQueriesSnapshot struct {
 	lastRecordTime time.Time
 	completed      []completedQueryResponse
+	bufferSize     int       // Entries returned by the node, before filtering
+	oldestRecord   time.Time // Oldest entry returned by the node
+	newestRecord   time.Time // Newest entry returned by the node
 }
 
 // ServerResponse Full server response aggregated
 type ServerResponse struct {
 	Node                  string
 	Active                []activeQueryResponse
+	ActiveCollected       bool
+	OldestActive          float64        // seconds
+	ActiveOverThreshold   []int          // Active queries over each long running threshold
+	Runaways              []RunawayQuery // Queries that crossed a long running threshold in this scrape
+	Cancellations         []Cancellation // Cancellations completed since the previous scrape, dry runs are reported at once
 	Completed             []completedQueryResponse
 	CompletedQueriesCount int64
 	CPUUser               float64
 	CPUSystem             float64
-	lastRecordTime        time.Time
+	CompletedOverflow     bool  // The completed requests buffer wrapped since the last scrape
+	CompletedLost         int64 // Estimated completed requests lost when the buffer wrapped
+	Vitals                Vitals
+	PreparedCollected     bool
+	Prepareds             []PreparedStatement // Sorted by uses, most used first
+	PreparedEvictions     int
+	PreparedReprepares    int
+	SettingsCollected     bool
+	Settings              map[string]float64 // Numeric query settings
+	SettingsDrift         map[string]bool    // Settings that differ from the cluster majority
+	// Only set when the monitor manages the completed requests settings
+	CompletedSettingsManaged  bool
+	CompletedSettingsInEffect bool
+	TimedOut                  bool // The node didn't answer within the scrape timeout, nothing was collected
+	lastRecordTime            time.Time
+	completedQualifiers       map[string]interface{} // Completed requests logging qualifiers, 6.5+ only
 }
 
 // ClusterResponse Collection of server metrics
 type ClusterResponse struct {
-	ClusterName     string
-	ServerResponses []ServerResponse
+	ClusterName           string
+	ServerResponses       []ServerResponse
+	LongRunningThresholds []time.Duration
+	Quantiles             []QuantileSummary // Completed requests quantiles per query type, when enabled
+}
+
+// Vitals Query service vitals, durations are converted to seconds
+type Vitals struct {
+	Collected         bool
+	Uptime            float64
+	Cores             float64
+	Goroutines        float64
+	MemoryUsage       float64
+	MemoryTotal       float64
+	MemorySystem      float64
+	GCCount           float64
+	GCPause           float64
+	GCPausePercent    float64
+	ActiveCount       float64
+	CompletedCount    float64
+	PreparedPercent   float64
+	RequestRate1Min   float64
+	RequestRate5Min   float64
+	RequestRate15Min  float64
+	RequestTimeMean   float64
+	RequestTimeMedian float64
+	RequestTime80     float64
+	RequestTime95     float64
+	RequestTime99     float64
+	Load              float64
 }
 
 type vitalsResponse struct {
-	CompletedCount int64   `json:"request.completed.count"`
-	CPUUser        float64 `json:"cpu.user.percent"`
-	CPUSystem      float64 `json:"cpu.sys.percent"`
+	CompletedCount    int64   `json:"request.completed.count"`
+	CPUUser           float64 `json:"cpu.user.percent"`
+	CPUSystem         float64 `json:"cpu.sys.percent"`
+	Uptime            string  `json:"uptime"`
+	Cores             float64 `json:"cores"`
+	Goroutines        float64 `json:"total.threads"`
+	MemoryUsage       float64 `json:"memory.usage"`
+	MemoryTotal       float64 `json:"memory.total"`
+	MemorySystem      float64 `json:"memory.system"`
+	GCCount           float64 `json:"gc.num"`
+	GCPause           string  `json:"gc.pause.time"`
+	GCPausePercent    float64 `json:"gc.pause.percent"`
+	ActiveCount       float64 `json:"request.active.count"`
+	PreparedPercent   float64 `json:"request.prepared.percent"`
+	RequestRate1Min   float64 `json:"request.per.sec.1min"`
+	RequestRate5Min   float64 `json:"request.per.sec.5min"`
+	RequestRate15Min  float64 `json:"request.per.sec.15min"`
+	RequestTimeMean   string  `json:"request_time.mean"`
+	RequestTimeMedian string  `json:"request_time.median"`
+	RequestTime80     string  `json:"request_time.80percentile"`
+	RequestTime95     string  `json:"request_time.95percentile"`
+	RequestTime99     string  `json:"request_time.99percentile"`
+	Load              float64 `json:"load"`
+	collected         bool
+}
+
+func toSeconds(t string) float64 {
+	parsed, err := time.ParseDuration(t)
+	if err == nil {
+		return parsed.Seconds()
+	}
+	return 0
+}
+
+func (v *vitalsResponse) toVitals() Vitals {
+	return Vitals{
+		Collected:         v.collected,
+		Uptime:            toSeconds(v.Uptime),
+		Cores:             v.Cores,
+		Goroutines:        v.Goroutines,
+		MemoryUsage:       v.MemoryUsage,
+		MemoryTotal:       v.MemoryTotal,
+		MemorySystem:      v.MemorySystem,
+		GCCount:           v.GCCount,
+		GCPause:           toSeconds(v.GCPause),
+		GCPausePercent:    v.GCPausePercent,
+		ActiveCount:       v.ActiveCount,
+		CompletedCount:    float64(v.CompletedCount),
+		PreparedPercent:   v.PreparedPercent,
+		RequestRate1Min:   v.RequestRate1Min,
+		RequestRate5Min:   v.RequestRate5Min,
+		RequestRate15Min:  v.RequestRate15Min,
+		RequestTimeMean:   toSeconds(v.RequestTimeMean),
+		RequestTimeMedian: toSeconds(v.RequestTimeMedian),
+		RequestTime80:     toSeconds(v.RequestTime80),
+		RequestTime95:     toSeconds(v.RequestTime95),
+		RequestTime99:     toSeconds(v.RequestTime99),
+		Load:              v.Load,
+	}
 }
 
 func getQueryType(statement string) string {
@@ -101,23 +246,24 @@ func getQueryType(statement string) string {
 	return "UNK"
 }
 
-func getVitalsInformation(server string, serverAuht *cbapi.Auth, c chan vitalsResponse) {
+func getVitalsInformation(ctx context.Context, server string, serverAuht *cbapi.Auth, c chan vitalsResponse) {
 	url := server + "/admin/vitals"
 	var serverVitals vitalsResponse
-	bytes := cbapi.GetAPI(url, serverAuht)
+	bytes := cbapi.GetAPI(ctx, url, serverAuht)
 	err := json.Unmarshal(bytes, &serverVitals)
 	if err == nil {
+		serverVitals.collected = true
 		c <- serverVitals
 	} else {
-		fmt.Printf("Server: %s\n%s\nError (vitals):\n%s\n", url, string(bytes), err.Error())
+		log.Printf("Server: %s\n%s\nError (vitals):\n%s\n", url, string(bytes), err.Error())
 		c <- vitalsResponse{}
 	}
 }
 
-func getActiveQueries(server string, serverAuth *cbapi.Auth, c chan []activeQueryResponse) {
+func getActiveQueries(ctx context.Context, server string, serverAuth *cbapi.Auth, c chan []activeQueryResponse) {
 	url := server + "/admin/active_requests"
 	var inProgress []activeQueryResponse
-	bytes := cbapi.GetAPI(url, serverAuth)
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
 	err := json.Unmarshal(bytes, &inProgress)
 	if err == nil {
 		for ndx, q := range inProgress {
@@ -125,24 +271,30 @@ func getActiveQueries(server string, serverAuth *cbapi.Auth, c chan []activeQuer
 			inProgress[ndx].ExecutionTime = cbapi.ToMillis(q.ExecutionTimeString)
 			inProgress[ndx].WaitingTime = inProgress[ndx].ElapsedTime - inProgress[ndx].ExecutionTime
 			inProgress[ndx].QueryType = getQueryType(q.Statement)
+			inProgress[ndx].Users = parseUsers(q.UsersRaw)
+			inProgress[ndx].NormalizedStatement = normalizeStatement(q.Statement)
+			inProgress[ndx].Fingerprint = fingerprint(inProgress[ndx].NormalizedStatement)
+			inProgress[ndx].UsersRaw = nil
 			inProgress[ndx].ElapsedTimeString = ""
 			inProgress[ndx].ExecutionTimeString = ""
 			inProgress[ndx].Statement = ""
 		}
 		c <- inProgress
 	} else {
-		fmt.Printf("Server: %s\\nError getting active queries:\n%s\n", url, err.Error())
-		c <- []activeQueryResponse{}
+		log.Printf("Server: %s\\nError getting active queries:\n%s\n", url, err.Error())
+		c <- nil
 	}
 }
 
-func getCompletedQueries(server string, serverAuth *cbapi.Auth, lastScrapped time.Time, isFirstRun bool, datelayout string, c chan completedQueriesSnapshot) {
+func getCompletedQueries(ctx context.Context, server string, serverAuth *cbapi.Auth, lastScrapped time.Time, isFirstRun bool, datelayout string, c chan completedQueriesSnapshot) {
 	url := server + "/admin/completed_requests"
 	var completed []completedQueryResponse
-	bytes := cbapi.GetAPI(url, serverAuth)
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
 	err := json.Unmarshal(bytes, &completed)
 	if err == nil {
 		completedFiltered := []completedQueryResponse{}
+		oldestRecord := time.Time{}
+		newestRecord := time.Time{}
 		for ndx, q := range completed {
 			completed[ndx].ElapsedTime = cbapi.ToMillis(q.ElapsedTimeString)
 			completed[ndx].ExecutionTime = cbapi.ToMillis(q.ExecutionTimeString)
@@ -153,6 +305,12 @@ func getCompletedQueries(server string, serverAuth *cbapi.Auth, lastScrapped tim
 				parsedDate, dateErr := time.Parse(datelayout, q.RequestTime)
 				if dateErr == nil {
 					completed[ndx].RequestTimeDate = parsedDate
+					if oldestRecord.IsZero() || parsedDate.Before(oldestRecord) {
+						oldestRecord = parsedDate
+					}
+					if parsedDate.After(newestRecord) {
+						newestRecord = parsedDate
+					}
 				} else {
 					log.Printf("Error formatting %s %s", q.RequestTime, dateErr)
 				}
@@ -168,9 +326,12 @@ func getCompletedQueries(server string, serverAuth *cbapi.Auth, lastScrapped tim
 		c <- completedQueriesSnapshot{
 			lastRecordTime: lastScrapped,
 			completed:      completedFiltered,
+			bufferSize:     len(completed),
+			oldestRecord:   oldestRecord,
+			newestRecord:   newestRecord,
 		}
 	} else {
-		fmt.Printf("Server: %s\nError getting completed queries:\n%s\n", url, err.Error())
+		log.Printf("Server: %s\nError getting completed queries:\n%s\n", url, err.Error())
 		c <- completedQueriesSnapshot{
 			lastRecordTime: lastScrapped,
 			completed:      []completedQueryResponse{},
@@ -178,61 +339,259 @@ func getCompletedQueries(server string, serverAuth *cbapi.Auth, lastScrapped tim
 	}
 }
 
+func getPreparedStatements(ctx context.Context, server string, serverAuth *cbapi.Auth, c chan []PreparedStatement) {
+	url := server + "/admin/prepareds"
+	var cached []preparedResponse
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
+	err := json.Unmarshal(bytes, &cached)
+	if err == nil {
+		prepareds := make([]PreparedStatement, len(cached), len(cached))
+		for ndx, p := range cached {
+			prepareds[ndx] = PreparedStatement{
+				Name:           p.Name,
+				Uses:           p.Uses,
+				AvgServiceTime: toSeconds(p.AvgServiceTime),
+			}
+		}
+		sort.Slice(prepareds, func(i, j int) bool {
+			return prepareds[i].Uses > prepareds[j].Uses
+		})
+		c <- prepareds
+	} else {
+		log.Printf("Server: %s\nError getting prepared statements:\n%s\n", url, err.Error())
+		c <- nil
+	}
+}
+
+type settingsResponse struct {
+	numeric             map[string]float64
+	completedQualifiers map[string]interface{}
+}
+
+// getSettings reads the numeric settings and the completed requests qualifiers
+// of a query node, other settings are ignored
+func getSettings(ctx context.Context, server string, serverAuth *cbapi.Auth, c chan settingsResponse) {
+	url := server + "/admin/settings"
+	var settings map[string]interface{}
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
+	err := json.Unmarshal(bytes, &settings)
+	if err == nil {
+		numeric := make(map[string]float64)
+		for name, value := range settings {
+			if number, ok := value.(float64); ok {
+				numeric[name] = number
+			}
+		}
+		qualifiers, _ := settings["completed"].(map[string]interface{})
+		c <- settingsResponse{numeric: numeric, completedQualifiers: qualifiers}
+	} else {
+		log.Printf("Server: %s\nError getting settings:\n%s\n", url, err.Error())
+		c <- settingsResponse{}
+	}
+}
+
+// detectSettingsDrift flags, per node, the settings whose value differs from
+// the value most nodes in the cluster have (the lowest value wins ties)
+func detectSettingsDrift(servers []ServerResponse) {
+	counts := make(map[string]map[float64]int)
+	for _, server := range servers {
+		for name, value := range server.Settings {
+			if counts[name] == nil {
+				counts[name] = make(map[float64]int)
+			}
+			counts[name][value]++
+		}
+	}
+	majority := make(map[string]float64)
+	for name, values := range counts {
+		best := 0
+		for value, count := range values {
+			if count > best || (count == best && value < majority[name]) {
+				best = count
+				majority[name] = value
+			}
+		}
+	}
+	for ndx := range servers {
+		if !servers[ndx].SettingsCollected {
+			continue
+		}
+		drift := make(map[string]bool)
+		for name, value := range servers[ndx].Settings {
+			drift[name] = value != majority[name]
+		}
+		servers[ndx].SettingsDrift = drift
+	}
+}
+
+// detectCompletedOverflow checks whether the completed requests buffer of a node
+// wrapped since the previous scrape: it is full and even its oldest entry is
+// newer than the watermark. Lost requests are estimated from the rate of the
+// entries in the buffer over the gap between the watermark and the oldest entry.
+func detectCompletedOverflow(snapshot completedQueriesSnapshot, watermark time.Time, isFirstRun bool, settings map[string]float64) (bool, int64) {
+	if isFirstRun || snapshot.bufferSize == 0 || snapshot.oldestRecord.IsZero() || watermark.IsZero() {
+		return false, 0
+	}
+	if limit, found := settings["completed-limit"]; found && float64(snapshot.bufferSize) < limit {
+		return false, 0
+	}
+	if !snapshot.oldestRecord.After(watermark) {
+		return false, 0
+	}
+	span := snapshot.newestRecord.Sub(snapshot.oldestRecord)
+	if span <= 0 {
+		return true, 0
+	}
+	gap := snapshot.oldestRecord.Sub(watermark)
+	return true, int64(float64(snapshot.bufferSize) * gap.Seconds() / span.Seconds())
+}
+
 // should return a channel with a server wrapper
-func getServerRecords(url string, serverAuth *cbapi.Auth, lastScrapped time.Time, isFirstRun bool, datelayout string, c chan ServerResponse) {
+func getServerRecords(ctx context.Context, node string, url string, serverAuth *cbapi.Auth, lastScrapped time.Time, isFirstRun bool, datelayout string, c chan ServerResponse) {
 	activeQueriesChannel := make(chan []activeQueryResponse)
 	completedQueriesChannel := make(chan completedQueriesSnapshot)
 	vitalsChannel := make(chan vitalsResponse)
-	go getActiveQueries(url, serverAuth, activeQueriesChannel)
-	go getCompletedQueries(url, serverAuth, lastScrapped, isFirstRun, datelayout, completedQueriesChannel)
-	go getVitalsInformation(url, serverAuth, vitalsChannel)
+	preparedsChannel := make(chan []PreparedStatement)
+	settingsChannel := make(chan settingsResponse)
+	go getActiveQueries(ctx, url, serverAuth, activeQueriesChannel)
+	go getCompletedQueries(ctx, url, serverAuth, lastScrapped, isFirstRun, datelayout, completedQueriesChannel)
+	go getVitalsInformation(ctx, url, serverAuth, vitalsChannel)
+	go getPreparedStatements(ctx, url, serverAuth, preparedsChannel)
+	go getSettings(ctx, url, serverAuth, settingsChannel)
 	activeQueries := <-activeQueriesChannel
 	completedQueries := <-completedQueriesChannel
 	vitalsInformation := <-vitalsChannel
+	prepareds := <-preparedsChannel
+	settings := <-settingsChannel
+	overflow, lost := detectCompletedOverflow(completedQueries, lastScrapped, isFirstRun, settings.numeric)
 	serverRecord := ServerResponse{
+		Node:                  node,
 		Active:                activeQueries,
+		ActiveCollected:       activeQueries != nil,
 		Completed:             completedQueries.completed,
 		lastRecordTime:        completedQueries.lastRecordTime,
 		CompletedQueriesCount: vitalsInformation.CompletedCount,
 		CPUUser:               vitalsInformation.CPUUser,
 		CPUSystem:             vitalsInformation.CPUSystem,
+		Vitals:                vitalsInformation.toVitals(),
+		CompletedOverflow:     overflow,
+		CompletedLost:         lost,
+		PreparedCollected:     prepareds != nil,
+		Prepareds:             prepareds,
+		SettingsCollected:     settings.numeric != nil,
+		Settings:              settings.numeric,
+		completedQualifiers:   settings.completedQualifiers,
 	}
 	c <- serverRecord
 }
 
-// Execute Retrieves server status
-func (m *Monitor) Execute() ClusterResponse {
+// trackPrepareds compares the prepared statements cache of a node with the
+// previous scrape: entries that disappeared were evicted, and evicted entries
+// that come back or entries whose uses went down were prepared again
+func (m *Monitor) trackPrepareds(server *ServerResponse) {
+	previous, known := m.preparedUses[server.Node]
+	evicted := m.preparedEvicted[server.Node]
+	if evicted == nil || len(evicted) > maxEvictedPrepareds {
+		evicted = make(map[string]bool)
+	}
+	current := make(map[string]int64)
+	for _, p := range server.Prepareds {
+		current[p.Name] = p.Uses
+		if !known {
+			continue
+		}
+		if evicted[p.Name] {
+			server.PreparedReprepares++
+			delete(evicted, p.Name)
+		} else if uses, found := previous[p.Name]; found && p.Uses < uses {
+			server.PreparedEvictions++
+			server.PreparedReprepares++
+		}
+	}
+	for name := range previous {
+		if _, found := current[name]; !found {
+			server.PreparedEvictions++
+			evicted[name] = true
+		}
+	}
+	m.preparedUses[server.Node] = current
+	m.preparedEvicted[server.Node] = evicted
+}
+
+// Execute Retrieves server status, the requests are aborted when ctx is done
+func (m *Monitor) Execute(ctx context.Context) ClusterResponse {
 	serversChannel := make(chan ServerResponse, len(m.Servers))
 	if len(m.Servers) > 0 {
 		log.Printf("Collecting metrics from cluster %s \n", m.ClusterName)
-		lastScrapper := time.Now()
-		isFirst := true
-		if m.scrapCount > 0 {
-			isFirst = false
+		var slots chan struct{}
+		if m.concurrency > 0 {
+			slots = make(chan struct{}, m.concurrency)
 		}
+		auth := m.HTTPAuth
+		// Nodes still running when the collection ends are aborted
+		var collectCtx context.Context
+		var cancel context.CancelFunc
+		if m.timeout > 0 {
+			collectCtx, cancel = context.WithTimeout(ctx, m.timeout)
+		} else {
+			collectCtx, cancel = context.WithCancel(ctx)
+		}
+		defer cancel()
 		for _, s := range m.Servers {
 			url := m.protocol + "://" + s + ":8093"
-			if m.scrapCount > 0 {
-				lastScrapper = m.lastRecordedQuery
+			// Every node has its own watermark so a node that timed out
+			// gets the requests it completed meanwhile on the next scrape
+			lastScrapped, found := m.lastRecorded[s]
+			if !found {
+				lastScrapped = time.Now()
 			}
-			go getServerRecords(url, &m.HTTPAuth, lastScrapper, isFirst, m.datelayout, serversChannel)
-		}
-		serverResponses := make([]ServerResponse, len(m.Servers), len(m.Servers))
-		if len(m.Servers) > 0 {
-
+			go func(node string, url string, lastScrapped time.Time, isFirst bool) {
+				if slots != nil {
+					slots <- struct{}{}
+					defer func() { <-slots }()
+				}
+				getServerRecords(collectCtx, node, url, &auth, lastScrapped, isFirst, m.datelayout, serversChannel)
+			}(s, url, lastScrapped, !found)
 		}
-		for ndx, s := range m.Servers {
-			serverRecord := <-serversChannel
-			serverRecord.Node = s
-			serverResponses[ndx] = serverRecord
-			if serverRecord.lastRecordTime.After(m.lastRecordedQuery) {
-				m.lastRecordedQuery = serverRecord.lastRecordTime
+		serverResponses := make([]ServerResponse, 0, len(m.Servers))
+		answered := make(map[string]bool)
+	collect:
+		for range m.Servers {
+			select {
+			case serverRecord := <-serversChannel:
+				if serverRecord.PreparedCollected {
+					m.trackPrepareds(&serverRecord)
+				}
+				if serverRecord.ActiveCollected {
+					m.trackActive(&serverRecord)
+					m.enforceCancelPolicy(ctx, &serverRecord)
+				}
+				serverResponses = append(serverResponses, serverRecord)
+				answered[serverRecord.Node] = true
+				if previous, found := m.lastRecorded[serverRecord.Node]; !found || serverRecord.lastRecordTime.After(previous) {
+					m.lastRecorded[serverRecord.Node] = serverRecord.lastRecordTime
+				}
+			case <-collectCtx.Done():
+				// Late nodes answer to the buffered channel and are dropped
+				for _, node := range m.Servers {
+					if !answered[node] {
+						if ctx.Err() == nil {
+							log.Printf("Node %s of cluster %s didn't answer within %s\n", node, m.ClusterName, m.timeout)
+						}
+						serverResponses = append(serverResponses, ServerResponse{Node: node, TimedOut: true})
+					}
+				}
+				break collect
 			}
 		}
+		detectSettingsDrift(serverResponses)
+		m.enforceCompletedSettings(ctx, serverResponses)
 		m.scrapCount = m.scrapCount + 1
 		return ClusterResponse{
-			ClusterName:     m.ClusterName,
-			ServerResponses: serverResponses,
+			ClusterName:           m.ClusterName,
+			ServerResponses:       serverResponses,
+			LongRunningThresholds: m.longRunning,
+			Quantiles:             m.trackQuantiles(serverResponses, time.Now()),
 		}
 	}
 	log.Printf("Skipping monitor for cluster %s since it has no servers\n", m.ClusterName)
@@ -242,6 +601,14 @@ func (m *Monitor) Execute() ClusterResponse {
 	}
 }
 
+// SetScrapeLimits bounds the collection of the query nodes: nodes not
+// answering within the timeout are reported as timed out and at most
+// concurrency nodes are scraped at once. Zero disables a limit.
+func (m *Monitor) SetScrapeLimits(timeout time.Duration, concurrency int) {
+	m.timeout = timeout
+	m.concurrency = concurrency
+}
+
 // New creates a new cluster monitor
 func New(clusterName string, servers []string, serverAuth cbapi.Auth, useHTTPS bool, datelayout string) Monitor {
 	protocol := "http"
@@ -249,10 +616,14 @@ func New(clusterName string, servers []string, serverAuth cbapi.Auth, useHTTPS b
 		protocol = "https"
 	}
 	return Monitor{
-		ClusterName: clusterName,
-		Servers:     servers,
-		HTTPAuth:    serverAuth,
-		protocol:    protocol,
-		datelayout:  datelayout,
+		ClusterName:     clusterName,
+		Servers:         servers,
+		HTTPAuth:        serverAuth,
+		protocol:        protocol,
+		datelayout:      datelayout,
+		lastRecorded:    make(map[string]time.Time),
+		preparedUses:    make(map[string]map[string]int64),
+		preparedEvicted: make(map[string]map[string]bool),
+		activeReported:  make(map[string]map[string]int),
 	}
 }
@@ -0,0 +1,205 @@
+package n1qlmonitor
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+)
+
+func TestTrackPrepareds(t *testing.T) {
+	m := New("test", []string{"node1"}, cbapi.Auth{}, false, "")
+	scrape := func(prepareds ...PreparedStatement) ServerResponse {
+		server := ServerResponse{Node: "node1", PreparedCollected: true, Prepareds: prepareds}
+		m.trackPrepareds(&server)
+		return server
+	}
+	scrape(PreparedStatement{Name: "a", Uses: 5}, PreparedStatement{Name: "b", Uses: 3})
+	server := scrape(PreparedStatement{Name: "a", Uses: 7})
+	if server.PreparedEvictions != 1 || server.PreparedReprepares != 0 {
+		t.Errorf("Expected 1 eviction and 0 reprepares, found %d and %d", server.PreparedEvictions, server.PreparedReprepares)
+	}
+	server = scrape(PreparedStatement{Name: "a", Uses: 1}, PreparedStatement{Name: "b", Uses: 1})
+	if server.PreparedEvictions != 1 || server.PreparedReprepares != 2 {
+		t.Errorf("Expected 1 eviction and 2 reprepares, found %d and %d", server.PreparedEvictions, server.PreparedReprepares)
+	}
+}
+
+func TestDetectSettingsDrift(t *testing.T) {
+	servers := []ServerResponse{
+		{Node: "node1", SettingsCollected: true, Settings: map[string]float64{"completed-limit": 4000}},
+		{Node: "node2", SettingsCollected: true, Settings: map[string]float64{"completed-limit": 4000}},
+		{Node: "node3", SettingsCollected: true, Settings: map[string]float64{"completed-limit": 10000}},
+		{Node: "node4"},
+	}
+	detectSettingsDrift(servers)
+	if servers[0].SettingsDrift["completed-limit"] || servers[1].SettingsDrift["completed-limit"] {
+		t.Errorf("Expected no drift in the nodes with the majority value")
+	}
+	if !servers[2].SettingsDrift["completed-limit"] {
+		t.Errorf("Expected drift in node3")
+	}
+	if servers[3].SettingsDrift != nil {
+		t.Errorf("Expected no drift information for a node without settings")
+	}
+}
+
+func TestDetectCompletedOverflow(t *testing.T) {
+	watermark := time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC)
+	snapshot := completedQueriesSnapshot{
+		bufferSize:   100,
+		oldestRecord: watermark.Add(10 * time.Second),
+		newestRecord: watermark.Add(20 * time.Second),
+	}
+	overflow, lost := detectCompletedOverflow(snapshot, watermark, false, map[string]float64{"completed-limit": 100})
+	if !overflow || lost != 100 {
+		t.Errorf("Expected an overflow losing 100 requests, found %v and %d", overflow, lost)
+	}
+	overflow, _ = detectCompletedOverflow(snapshot, watermark, false, map[string]float64{"completed-limit": 4000})
+	if overflow {
+		t.Errorf("Expected no overflow when the buffer is not full")
+	}
+	snapshot.oldestRecord = watermark.Add(-time.Second)
+	overflow, _ = detectCompletedOverflow(snapshot, watermark, false, nil)
+	if overflow {
+		t.Errorf("Expected no overflow when the buffer still has the watermark")
+	}
+}
+
+func TestTrackActive(t *testing.T) {
+	m := New("test", []string{"node1"}, cbapi.Auth{}, false, "")
+	m.SetLongRunningThresholds([]time.Duration{5 * time.Minute, time.Minute})
+	scrape := func(elapsed int64) ServerResponse {
+		server := ServerResponse{Node: "node1", ActiveCollected: true, Active: []activeQueryResponse{
+			{RequestID: "r1", ElapsedTime: elapsed},
+			{RequestID: "r2", ElapsedTime: 1000},
+		}}
+		m.trackActive(&server)
+		return server
+	}
+	server := scrape(90 * 1000)
+	if server.OldestActive != 90 || server.ActiveOverThreshold[0] != 1 || server.ActiveOverThreshold[1] != 0 || len(server.Runaways) != 1 {
+		t.Errorf("Unexpected tracking after the first scrape: %+v", server)
+	}
+	server = scrape(100 * 1000)
+	if len(server.Runaways) != 0 {
+		t.Errorf("Expected a long running query to be reported once per threshold, found %d events", len(server.Runaways))
+	}
+	server = scrape(400 * 1000)
+	if len(server.Runaways) != 1 || server.Runaways[0].Threshold != 5*time.Minute {
+		t.Errorf("Expected the 5m threshold to be reported, found %+v", server.Runaways)
+	}
+}
+
+func TestNormalizeStatement(t *testing.T) {
+	a := normalizeStatement(`SELECT * FROM b WHERE id = "k1" AND n > 10`)
+	b := normalizeStatement("SELECT *  FROM b WHERE id = 'k2'\n AND n > 25.5")
+	if a != b || fingerprint(a) != fingerprint(b) {
+		t.Errorf("Expected the same normalized statement, found %q and %q", a, b)
+	}
+}
+
+func TestCancelPolicyDryRun(t *testing.T) {
+	m := New("test", []string{"node1"}, cbapi.Auth{}, false, "")
+	err := m.SetCancelPolicy(CancelPolicy{Enabled: true, Rules: []CancelRule{{Name: "no-limit", Users: ".*"}}})
+	if err == nil {
+		t.Errorf("Expected a rule without maxelapsed to be rejected")
+	}
+	err = m.SetCancelPolicy(CancelPolicy{Enabled: true, DryRun: true, Rules: []CancelRule{{Name: "reports", MaxElapsed: "1m", Users: "^report_"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	scrape := func() ServerResponse {
+		server := ServerResponse{Node: "node1", ActiveCollected: true, Active: []activeQueryResponse{
+			{RequestID: "r1", ElapsedTime: 120 * 1000, Users: "report_daily"},
+			{RequestID: "r2", ElapsedTime: 120 * 1000, Users: "app"},
+			{RequestID: "r3", ElapsedTime: 1000, Users: "report_daily"},
+		}}
+		m.enforceCancelPolicy(context.Background(), &server)
+		return server
+	}
+	server := scrape()
+	if len(server.Cancellations) != 1 || server.Cancellations[0].Query.RequestID != "r1" || !server.Cancellations[0].DryRun {
+		t.Errorf("Expected r1 to be cancelled in dry run, found %+v", server.Cancellations)
+	}
+	server = scrape()
+	if len(server.Cancellations) != 0 {
+		t.Errorf("Expected r1 to be handled only once, found %+v", server.Cancellations)
+	}
+}
+
+func TestCancelPolicyRetry(t *testing.T) {
+	// Nothing listens on the query port of the node so every cancellation fails
+	m := New("test", []string{"127.0.0.1"}, cbapi.Auth{}, false, "")
+	err := m.SetCancelPolicy(CancelPolicy{Enabled: true, Rules: []CancelRule{{Name: "reports", MaxElapsed: "1m", Users: "^report_"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	scrape := func(active ...activeQueryResponse) ServerResponse {
+		server := ServerResponse{Node: "127.0.0.1", ActiveCollected: true, Active: active}
+		m.enforceCancelPolicy(context.Background(), &server)
+		m.cancelPolicy.running.Wait()
+		return server
+	}
+	runaway := activeQueryResponse{RequestID: "r1", ElapsedTime: 120 * 1000, Users: "report_daily"}
+	server := scrape(runaway)
+	if len(server.Cancellations) != 0 {
+		t.Errorf("Expected the cancellation to be reported on the next scrape, found %+v", server.Cancellations)
+	}
+	server = scrape(runaway)
+	if len(server.Cancellations) != 1 || server.Cancellations[0].Error == nil {
+		t.Fatalf("Expected a failed cancellation of r1, found %+v", server.Cancellations)
+	}
+	server = scrape()
+	if len(server.Cancellations) != 1 || server.Cancellations[0].Error == nil {
+		t.Errorf("Expected r1 to be retried while it was active, found %+v", server.Cancellations)
+	}
+	server = scrape()
+	if len(server.Cancellations) != 0 {
+		t.Errorf("Expected r1 not to be retried once it finished, found %+v", server.Cancellations)
+	}
+}
+
+func TestTrackQuantiles(t *testing.T) {
+	m := New("test", []string{"node1"}, cbapi.Auth{}, false, "")
+	m.SetQuantiles(QuantileSettings{Objectives: map[float64]float64{0.5: 0.01, 0.99: 0.001}, MaxAge: time.Minute, AgeBuckets: 2})
+	now := time.Now()
+	completed := make([]completedQueryResponse, 100)
+	for ndx := range completed {
+		completed[ndx] = completedQueryResponse{QueryType: "SELECT", ElapsedTime: int64(ndx+1) * 10, ExecutionTime: 5}
+	}
+	summaries := m.trackQuantiles([]ServerResponse{{Node: "node1", Completed: completed}}, now)
+	if len(summaries) != 2 || summaries[0].Kind != "elapsed" || summaries[0].Count != 100 {
+		t.Fatalf("Unexpected summaries %+v", summaries)
+	}
+	if p50 := summaries[0].Quantiles[0.5]; p50 < 0.49 || p50 > 0.51 {
+		t.Errorf("Expected p50 of 0.5s, found %v", p50)
+	}
+	summaries = m.trackQuantiles([]ServerResponse{{Node: "node1"}}, now.Add(2*time.Minute))
+	if summaries[0].Count != 100 || !math.IsNaN(summaries[0].Quantiles[0.5]) {
+		t.Errorf("Expected the window to forget old requests but keep the count, found %+v", summaries[0])
+	}
+}
+
+func TestCompletedSettingsQualifierDrift(t *testing.T) {
+	threshold := int64(1000)
+	settings := CompletedSettings{Threshold: &threshold, Qualifiers: map[string]interface{}{"aborted": true, "error": float64(12003)}}
+	server := ServerResponse{
+		SettingsCollected:   true,
+		Settings:            map[string]float64{"completed-threshold": 1000},
+		completedQualifiers: map[string]interface{}{"aborted": nil, "error": float64(12003), "threshold": float64(1000)},
+	}
+	if !settings.inEffect(&server) {
+		t.Errorf("Expected the settings to be in effect")
+	}
+	server.completedQualifiers = map[string]interface{}{"aborted": nil, "error": float64(5000)}
+	if settings.inEffect(&server) {
+		t.Errorf("Expected a changed error qualifier to be detected")
+	}
+	server.completedQualifiers = map[string]interface{}{"error": float64(12003)}
+	if settings.inEffect(&server) {
+		t.Errorf("Expected a removed aborted qualifier to be detected")
+	}
+}
@@ -0,0 +1,155 @@
+package n1qlmonitor
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+)
+
+// QuantileSettings Objectives (quantile -> allowed error) and sliding window
+// of the completed requests quantiles
+type QuantileSettings struct {
+	Objectives map[float64]float64
+	MaxAge     time.Duration // Observations older than this are forgotten
+	AgeBuckets int           // Streams rotated within MaxAge, more buckets means a smoother window
+}
+
+// QuantileSummary Completed requests quantiles of a query type, Count and Sum
+// cover every request observed since the exporter started
+type QuantileSummary struct {
+	QueryType string
+	Kind      string // elapsed or service
+	Count     uint64
+	Sum       float64             // seconds
+	Quantiles map[float64]float64 // quantile -> seconds
+}
+
+// slidingQuantiles CKMS targeted quantiles over a sliding window, every
+// observation goes to all the streams and the oldest one is queried and reset
+// once its age reaches MaxAge, as the Prometheus summaries do
+type slidingQuantiles struct {
+	streams    []*quantile.Stream
+	head       int
+	headExpiry time.Time
+	count      uint64
+	sum        float64
+}
+
+type quantileKey struct {
+	queryType string
+	kind      string
+}
+
+type quantileTracker struct {
+	settings  QuantileSettings
+	quantiles map[quantileKey]*slidingQuantiles
+}
+
+func newSlidingQuantiles(settings QuantileSettings, now time.Time) *slidingQuantiles {
+	sliding := &slidingQuantiles{
+		streams:    make([]*quantile.Stream, settings.AgeBuckets),
+		headExpiry: now.Add(settings.MaxAge / time.Duration(settings.AgeBuckets)),
+	}
+	for ndx := range sliding.streams {
+		sliding.streams[ndx] = quantile.NewTargeted(settings.Objectives)
+	}
+	return sliding
+}
+
+// rotate resets the streams that outlived the window
+func (s *slidingQuantiles) rotate(settings QuantileSettings, now time.Time) {
+	bucketAge := settings.MaxAge / time.Duration(settings.AgeBuckets)
+	for !now.Before(s.headExpiry) {
+		s.streams[s.head].Reset()
+		s.head = (s.head + 1) % len(s.streams)
+		s.headExpiry = s.headExpiry.Add(bucketAge)
+	}
+}
+
+func (s *slidingQuantiles) observe(settings QuantileSettings, value float64, now time.Time) {
+	s.rotate(settings, now)
+	for _, stream := range s.streams {
+		stream.Insert(value)
+	}
+	s.count++
+	s.sum += value
+}
+
+// query returns the quantiles of the window, NaN when it has no observations
+// as the Prometheus summaries do
+func (s *slidingQuantiles) query(settings QuantileSettings) map[float64]float64 {
+	head := s.streams[s.head]
+	quantiles := make(map[float64]float64, len(settings.Objectives))
+	for q := range settings.Objectives {
+		if head.Count() == 0 {
+			quantiles[q] = math.NaN()
+			continue
+		}
+		quantiles[q] = head.Query(q)
+	}
+	return quantiles
+}
+
+// SetQuantiles enables the quantiles of the completed requests elapsed and
+// service times per query type
+func (m *Monitor) SetQuantiles(settings QuantileSettings) {
+	if len(settings.Objectives) == 0 {
+		m.quantiles = nil
+		return
+	}
+	if settings.MaxAge <= 0 {
+		settings.MaxAge = 10 * time.Minute
+	}
+	if settings.AgeBuckets <= 0 {
+		settings.AgeBuckets = 5
+	}
+	m.quantiles = &quantileTracker{
+		settings:  settings,
+		quantiles: make(map[quantileKey]*slidingQuantiles),
+	}
+}
+
+func (t *quantileTracker) observe(queryType string, kind string, value float64, now time.Time) {
+	key := quantileKey{queryType: queryType, kind: kind}
+	sliding, found := t.quantiles[key]
+	if !found {
+		sliding = newSlidingQuantiles(t.settings, now)
+		t.quantiles[key] = sliding
+	}
+	sliding.observe(t.settings, value, now)
+}
+
+// trackQuantiles feeds the requests completed in every node to the quantiles
+// and returns them per query type
+func (m *Monitor) trackQuantiles(servers []ServerResponse, now time.Time) []QuantileSummary {
+	tracker := m.quantiles
+	if tracker == nil {
+		return nil
+	}
+	for _, server := range servers {
+		for _, query := range server.Completed {
+			tracker.observe(query.QueryType, "elapsed", float64(query.ElapsedTime)/1000, now)
+			tracker.observe(query.QueryType, "service", float64(query.ExecutionTime)/1000, now)
+		}
+	}
+	summaries := make([]QuantileSummary, 0, len(tracker.quantiles))
+	for key, sliding := range tracker.quantiles {
+		sliding.rotate(tracker.settings, now)
+		summaries = append(summaries, QuantileSummary{
+			QueryType: key.queryType,
+			Kind:      key.kind,
+			Count:     sliding.count,
+			Sum:       sliding.sum,
+			Quantiles: sliding.query(tracker.settings),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].QueryType != summaries[j].QueryType {
+			return summaries[i].QueryType < summaries[j].QueryType
+		}
+		return summaries[i].Kind < summaries[j].Kind
+	})
+	return summaries
+}
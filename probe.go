@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/elfido/n1qlExporter/datamonitor"
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeExpiry Probed targets not probed again within this time are forgotten
+const probeExpiry = time.Hour
+
+// maxProbeTargets Probed targets kept at once, the least recently probed ones
+// are forgotten first
+const maxProbeTargets = 1000
+
+// probeConfiguration Credentials per module name, the quantiles and the
+// prepared statements reported per node of the probed clusters, replaced on
+// every configuration reload
+type probeConfiguration struct {
+	mutex       sync.RWMutex
+	modules     map[string]probeModule
+	quantiles   n1qlmonitor.QuantileSettings
+	preparedTop int
+}
+
+var probeConfig = &probeConfiguration{}
+
+func (p *probeConfiguration) set(modules map[string]probeModule, quantiles n1qlmonitor.QuantileSettings, preparedTop int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.modules = modules
+	p.quantiles = quantiles
+	p.preparedTop = preparedTop
+}
+
+func (p *probeConfiguration) get(moduleName string) (probeModule, n1qlmonitor.QuantileSettings, int, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	module, found := p.modules[moduleName]
+	return module, p.quantiles, p.preparedTop, found
+}
+
+// probeTarget Query monitor and metrics of a probed cluster, kept between
+// probes so the completed requests are only read once, the quantiles have a
+// window and the counters and histograms accumulate like in the scrape loop
+type probeTarget struct {
+	mutex        sync.Mutex
+	monitor      n1qlmonitor.Monitor
+	metrics      *queryMetrics
+	serverGroups map[string]string // Node -> server group
+	discovered   time.Time
+	lastProbe    time.Time // Protected by the probeTargets mutex
+}
+
+// newProbeMetrics creates the metrics of a probed cluster, the histograms have
+// the buckets of the scrape loop
+func newProbeMetrics() *queryMetrics {
+	metrics := newQueryMetrics()
+	metrics.buildHistograms(histogramsInUse)
+	if *legacyHistogramMetrics {
+		metrics.buildLegacyHistograms()
+	}
+	return metrics
+}
+
+type probeTargets struct {
+	mutex   sync.Mutex
+	targets map[string]*probeTarget // module/target -> monitor
+}
+
+var probedTargets = &probeTargets{
+	targets: make(map[string]*probeTarget),
+}
+
+// get returns the probe target kept for key, nil when it wasn't probed
+// successfully before, and forgets the expired ones
+func (p *probeTargets) get(key string) *probeTarget {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for probedKey, probed := range p.targets {
+		if now.Sub(probed.lastProbe) > probeExpiry {
+			delete(p.targets, probedKey)
+		}
+	}
+	probed, found := p.targets[key]
+	if !found {
+		return nil
+	}
+	probed.lastProbe = now
+	return probed
+}
+
+// add keeps a probe target once its cluster was discovered, forgetting the
+// least recently probed target beyond maxProbeTargets
+func (p *probeTargets) add(key string, probed *probeTarget) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(p.targets) >= maxProbeTargets {
+		oldest := ""
+		for probedKey, probed := range p.targets {
+			if oldest == "" || probed.lastProbe.Before(p.targets[oldest].lastProbe) {
+				oldest = probedKey
+			}
+		}
+		delete(p.targets, oldest)
+	}
+	probed.lastProbe = time.Now()
+	p.targets[key] = probed
+}
+
+// execute discovers the cluster when needed, runs its query monitor and reports
+// the metrics, the requests are aborted when ctx is done
+func (p *probeTarget) execute(ctx context.Context, target string, module probeModule, quantiles n1qlmonitor.QuantileSettings, preparedTop int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.monitor.Servers) == 0 || time.Since(p.discovered) >= renewInterval {
+		protocol := "http"
+		if module.UseHTTPS {
+			protocol = "https"
+		}
+		auth := module.auth(cbapi.Auth{})
+		clusterMap, err := datamonitor.GetClusterMap(ctx, protocol+"://"+target, auth)
+		if err != nil {
+			return err
+		}
+		if len(clusterMap.QueryNodes) == 0 {
+			return fmt.Errorf("no query nodes found")
+		}
+		clusterName := clusterMap.Name
+		if clusterName == "" {
+			clusterName = target
+		}
+		if len(p.monitor.Servers) == 0 || p.monitor.ClusterName != clusterName {
+			p.monitor = n1qlmonitor.New(clusterName, clusterMap.QueryNodes, auth, module.UseHTTPS, dateLayout(clusterMap.Version))
+			p.monitor.SetQuantiles(quantiles)
+			p.metrics = newProbeMetrics()
+		} else {
+			p.forgetNodes(clusterMap.QueryNodes, clusterMap.ServerGroups)
+			p.monitor.Servers = clusterMap.QueryNodes
+		}
+		p.serverGroups = clusterMap.ServerGroups
+		p.discovered = time.Now()
+	}
+	metrics := p.monitor.Execute(ctx)
+	p.metrics.report(&metrics, p.serverGroups, preparedTop)
+	return nil
+}
+
+// forgetNodes deletes the series of the query nodes that left the cluster or
+// moved to another server group since the previous discovery
+func (p *probeTarget) forgetNodes(nodes []string, serverGroups map[string]string) {
+	current := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		current[node] = true
+	}
+	for _, node := range p.monitor.Servers {
+		if !current[node] || serverGroups[node] != p.serverGroups[node] {
+			p.metrics.forgetNode(p.monitor.ClusterName, node, p.serverGroups[node])
+		}
+	}
+}
+
+// probeHandler scrapes the cluster of the target on demand with the
+// credentials of the module, blackbox exporter style. Only the targets
+// allowed by the module are probed so its credentials aren't sent elsewhere.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		http.Error(w, "module parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module, quantiles, preparedTop, found := probeConfig.get(moduleName)
+	if !found {
+		http.Error(w, fmt.Sprintf("unknown module %s", moduleName), http.StatusBadRequest)
+		return
+	}
+	if !module.allows(target) {
+		http.Error(w, fmt.Sprintf("target %s is not allowed by module %s", target, moduleName), http.StatusForbidden)
+		return
+	}
+	start := time.Now()
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the cluster could be discovered and scraped",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Time taken by the probe",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess, probeDuration)
+
+	key := moduleName + "/" + target
+	probed := probedTargets.get(key)
+	kept := probed != nil
+	if !kept {
+		probed = &probeTarget{}
+	}
+	err := probed.execute(r.Context(), target, module, quantiles, preparedTop)
+	if err == nil && !kept {
+		probedTargets.add(key, probed)
+	}
+	if err != nil {
+		log.Printf("Probe of %s with module %s failed: %s\n", target, moduleName, err.Error())
+	} else {
+		registerProbeMetrics(registry, probed)
+		probeSuccess.Set(1)
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// registerProbeMetrics exposes the metrics of a probed cluster in the registry
+// of the probe, the same families as the scrape loop
+func registerProbeMetrics(registry *prometheus.Registry, probed *probeTarget) {
+	probed.mutex.Lock()
+	defer probed.mutex.Unlock()
+	queryNodes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "n1ql_probe_query_nodes",
+		Help:        "N1QL query nodes scraped by the probe",
+		ConstLabels: prometheus.Labels{"cluster": probed.monitor.ClusterName},
+	})
+	queryNodes.Set(float64(len(probed.monitor.Servers)))
+	registry.MustRegister(queryNodes, probed.metrics.vitals, probed.metrics.quantiles)
+	for _, vector := range probed.metrics.vectors() {
+		registry.MustRegister(vector)
+	}
+}
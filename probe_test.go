@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProbeHandler(t *testing.T) {
+	// Nothing listens on the Couchbase port of the target so the probe fails
+	target := "127.0.0.1"
+	module := probeModule{Targets: `127\.0\.0\.1`}
+	if err := module.compileTargets(); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	probeConfig.set(map[string]probeModule{"local": module}, n1qlmonitor.QuantileSettings{}, 10)
+	defer probeConfig.set(nil, n1qlmonitor.QuantileSettings{}, 10)
+
+	for _, request := range []struct {
+		query  string
+		status int
+	}{
+		{"module=local", http.StatusBadRequest},
+		{"target=" + target, http.StatusBadRequest},
+		{"target=" + target + "&module=default", http.StatusBadRequest},
+		{"target=evil.example.com&module=local", http.StatusForbidden},
+		{"target=127.0.0.10&module=local", http.StatusForbidden},
+		{"target=" + target + "&module=local", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		probeHandler(w, httptest.NewRequest("GET", "/probe?"+request.query, nil))
+		if w.Code != request.status {
+			t.Errorf("%s: expected status %d, found %d", request.query, request.status, w.Code)
+		}
+		if w.Code == http.StatusOK {
+			body, _ := ioutil.ReadAll(w.Body)
+			if !strings.Contains(string(body), "probe_success 0") {
+				t.Errorf("Expected a failed probe, found:\n%s", string(body))
+			}
+		}
+	}
+	if probedTargets.get("local/"+target) != nil {
+		t.Errorf("Expected the failed probe target not to be kept")
+	}
+}
+
+func TestRegisterProbeMetrics(t *testing.T) {
+	probed := &probeTarget{
+		monitor:      n1qlmonitor.Monitor{ClusterName: "PROBED", Servers: []string{"n1"}},
+		metrics:      newProbeMetrics(),
+		serverGroups: map[string]string{"n1": "g1"},
+	}
+	probed.metrics.report(&n1qlmonitor.ClusterResponse{
+		ClusterName: "PROBED",
+		ServerResponses: []n1qlmonitor.ServerResponse{{
+			Node:              "n1",
+			ActiveCollected:   true,
+			CPUUser:           10,
+			PreparedCollected: true,
+			Prepareds:         []n1qlmonitor.PreparedStatement{{Name: "p1", Uses: 3}},
+			Settings:          map[string]float64{"max-parallelism": 4},
+		}},
+	}, probed.serverGroups, 10)
+	registry := prometheus.NewRegistry()
+	registerProbeMetrics(registry, probed)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	found := make(map[string]bool)
+	for _, family := range families {
+		found[family.GetName()] = true
+		for _, metric := range family.Metric {
+			for _, pair := range metric.Label {
+				if pair.GetName() == "server_group" && pair.GetValue() != "g1" {
+					t.Errorf("Expected the server group of the node in %s, found %q", family.GetName(), pair.GetValue())
+				}
+			}
+		}
+	}
+	for _, name := range []string{"n1ql_probe_query_nodes", "n1ql_active_oldest_query_seconds", "n1ql_vitals_cpu_usage",
+		"n1ql_vitals_completed_queries", "n1ql_settings", "n1ql_prepared_cache_size", "n1ql_prepared_uses"} {
+		if !found[name] {
+			t.Errorf("Expected %s to be exported by the probe", name)
+		}
+	}
+}
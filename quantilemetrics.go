@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Completed requests quantiles are estimated by the query monitor over a
+// sliding window, so they are exported as-is from the last scrape.
+var (
+	completedElapsedQuantilesDesc = prometheus.NewDesc("n1ql_completed_elapsed_seconds",
+		"N1QL completed requests elapsed time quantiles over a sliding window", []string{"cluster", "query_type"}, nil)
+	completedServiceQuantilesDesc = prometheus.NewDesc("n1ql_completed_service_seconds",
+		"N1QL completed requests service time quantiles over a sliding window", []string{"cluster", "query_type"}, nil)
+)
+
+// quantilesCollector exports the last quantiles computed per cluster
+type quantilesCollector struct {
+	mutex    sync.Mutex
+	clusters map[string][]n1qlmonitor.QuantileSummary
+}
+
+func (c *quantilesCollector) update(metrics *n1qlmonitor.ClusterResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clusters[metrics.ClusterName] = metrics.Quantiles
+}
+
+// forget drops the quantiles of a cluster that is not monitored anymore
+func (c *quantilesCollector) forget(clusterName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.clusters, clusterName)
+}
+
+// Describe implements prometheus.Collector
+func (c *quantilesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- completedElapsedQuantilesDesc
+	ch <- completedServiceQuantilesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *quantilesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for clusterName, summaries := range c.clusters {
+		for _, summary := range summaries {
+			desc := completedElapsedQuantilesDesc
+			if summary.Kind == "service" {
+				desc = completedServiceQuantilesDesc
+			}
+			ch <- prometheus.MustNewConstSummary(desc, summary.Count, summary.Sum, summary.Quantiles, clusterName, summary.QueryType)
+		}
+	}
+}
+
+func initQuantileMetrics() {
+	registerMetrics(scrapeMetrics.quantiles)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// relabelRule Rewrites, keeps or drops the series of a cluster by the value
+// of their node or query_type label
+type relabelRule struct {
+	Label       string `json:"label" schema:"required" enum:"node,query_type"`
+	Action      string `json:"action" enum:"replace,keep,drop"` // replace by default
+	Regex       string `json:"regex"`                           // Matches the whole value, (.*) by default
+	Replacement string `json:"replacement"`                     // $1 by default
+}
+
+var (
+	relabelLabels  = []string{"node", "query_type"}
+	relabelActions = []string{"replace", "keep", "drop"}
+)
+
+// labelNamePattern Valid Prometheus label names, names starting with __ are
+// reserved
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var (
+	registeredCollectors []prometheus.Collector
+	registeredMutex      sync.Mutex
+)
+
+// registerMetrics registers collectors of exporter series, static labels
+// can't be named after their labels
+func registerMetrics(collectors ...prometheus.Collector) {
+	prometheus.MustRegister(collectors...)
+	registeredMutex.Lock()
+	defer registeredMutex.Unlock()
+	registeredCollectors = append(registeredCollectors, collectors...)
+}
+
+var (
+	descVariableLabels = regexp.MustCompile(`variableLabels: \[([^\]]*)\]`)
+	descConstLabels    = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="`)
+)
+
+// exporterLabels returns the labels of the registered series, read from the
+// descriptors of their collectors, and the labels added by the histograms and
+// summaries
+func exporterLabels() map[string]bool {
+	reserved := map[string]bool{"le": true, "quantile": true}
+	registeredMutex.Lock()
+	collectors := registeredCollectors
+	registeredMutex.Unlock()
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		for _, collector := range collectors {
+			collector.Describe(descs)
+		}
+		close(descs)
+	}()
+	for desc := range descs {
+		// Desc doesn't expose its labels, only its description
+		description := desc.String()
+		if match := descVariableLabels.FindStringSubmatch(description); match != nil {
+			for _, name := range strings.Fields(match[1]) {
+				reserved[name] = true
+			}
+		}
+		if start := strings.Index(description, "constLabels: {"); start >= 0 {
+			end := strings.Index(description[start:], "}")
+			for _, match := range descConstLabels.FindAllStringSubmatch(description[start:start+end], -1) {
+				reserved[match[1]] = true
+			}
+		}
+	}
+	return reserved
+}
+
+// checkLabelName returns why a static label name can't be used
+func checkLabelName(name string) error {
+	if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if exporterLabels()[name] {
+		return fmt.Errorf("label %s is set by the exporter", name)
+	}
+	return nil
+}
+
+type compiledRule struct {
+	relabelRule
+	regex *regexp.Regexp
+}
+
+// compile checks a rule and fills in its defaults
+func (r relabelRule) compile() (compiledRule, error) {
+	found := false
+	for _, label := range relabelLabels {
+		found = found || r.Label == label
+	}
+	if !found {
+		return compiledRule{}, fmt.Errorf("label must be one of %s", strings.Join(relabelLabels, ", "))
+	}
+	if r.Action == "" {
+		r.Action = "replace"
+	}
+	found = false
+	for _, action := range relabelActions {
+		found = found || r.Action == action
+	}
+	if !found {
+		return compiledRule{}, fmt.Errorf("action must be one of %s", strings.Join(relabelActions, ", "))
+	}
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return compiledRule{}, fmt.Errorf("invalid regex %q: %s", r.Regex, err.Error())
+	}
+	return compiledRule{relabelRule: r, regex: regex}, nil
+}
+
+// clusterLabels Static labels and relabeling rules of a cluster
+type clusterLabels struct {
+	static map[string]string
+	rules  []compiledRule
+}
+
+// newClusterLabels compiles the labels of a cluster, invalid rules are
+// reported by the validation and ignored
+func newClusterLabels(static map[string]string, rules []relabelRule) clusterLabels {
+	labels := clusterLabels{static: static}
+	for _, rule := range rules {
+		compiled, err := rule.compile()
+		if err != nil {
+			log.Printf("Invalid relabel rule for %s: %s\n", rule.Label, err.Error())
+			continue
+		}
+		labels.rules = append(labels.rules, compiled)
+	}
+	return labels
+}
+
+// relabel applies the rules and adds the static labels to a series, it
+// returns false when the series is dropped
+func (c clusterLabels) relabel(metric *dto.Metric) bool {
+	for _, rule := range c.rules {
+		var pair *dto.LabelPair
+		for _, label := range metric.Label {
+			if label.GetName() == rule.Label {
+				pair = label
+			}
+		}
+		if pair == nil {
+			continue
+		}
+		matches := rule.regex.MatchString(pair.GetValue())
+		switch rule.Action {
+		case "keep":
+			if !matches {
+				return false
+			}
+		case "drop":
+			if matches {
+				return false
+			}
+		default:
+			if matches {
+				value := rule.regex.ReplaceAllString(pair.GetValue(), rule.Replacement)
+				pair.Value = &value
+			}
+		}
+	}
+	if len(c.static) == 0 {
+		return true
+	}
+	present := make(map[string]bool, len(metric.Label))
+	for _, label := range metric.Label {
+		present[label.GetName()] = true
+	}
+	for name, value := range c.static {
+		if present[name] {
+			continue
+		}
+		name, value := name, value
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+	return true
+}
+
+// relabeler Gatherer applying the labels of every cluster to the series with
+// its cluster label
+type relabeler struct {
+	gatherer prometheus.Gatherer
+	mutex    sync.RWMutex
+	clusters map[string]clusterLabels // cluster label -> labels
+	logged   map[string]bool          // cluster/metric name collisions already logged
+}
+
+var clusterRelabeler = &relabeler{
+	gatherer: prometheus.DefaultGatherer,
+	clusters: make(map[string]clusterLabels),
+}
+
+// set replaces the labels of the clusters, on every configuration reload
+func (r *relabeler) set(clusters map[string]clusterLabels) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clusters = clusters
+	r.logged = make(map[string]bool)
+}
+
+// Gather implements prometheus.Gatherer. Replacements must keep the series
+// distinct: series made identical by the rules are all dropped, since keeping
+// one of them or adding them up would export wrong values, and counted in
+// n1ql_exporter_relabel_collisions_total.
+func (r *relabeler) Gather() ([]*dto.MetricFamily, error) {
+	families, err := r.gatherer.Gather()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.clusters) == 0 {
+		return families, err
+	}
+	relabeled := families[:0]
+	for _, family := range families {
+		kept := family.Metric[:0]
+		keys := []string{}
+		series := make(map[string]int)
+		for _, metric := range family.Metric {
+			labels, found := r.clusters[clusterOf(metric)]
+			if found && !labels.relabel(metric) {
+				continue
+			}
+			key := seriesKey(metric)
+			series[key]++
+			keys = append(keys, key)
+			kept = append(kept, metric)
+		}
+		metrics := kept[:0]
+		for ndx, metric := range kept {
+			if series[keys[ndx]] == 1 {
+				metrics = append(metrics, metric)
+				continue
+			}
+			r.collision(clusterOf(metric), family.GetName())
+		}
+		family.Metric = metrics
+		if len(metrics) > 0 {
+			relabeled = append(relabeled, family)
+		}
+	}
+	return relabeled, err
+}
+
+// collision counts a series dropped by a relabeling collision, logging it once
+// per cluster and metric until the next reload
+func (r *relabeler) collision(cluster string, name string) {
+	relabelCollisions.WithLabelValues(cluster).Inc()
+	if r.logged == nil {
+		r.logged = make(map[string]bool)
+	}
+	if key := cluster + "/" + name; !r.logged[key] {
+		r.logged[key] = true
+		log.Printf("Relabeling rules of cluster %s make series of %s identical, dropping them\n", cluster, name)
+	}
+}
+
+func clusterOf(metric *dto.Metric) string {
+	for _, label := range metric.Label {
+		if label.GetName() == "cluster" {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func seriesKey(metric *dto.Metric) string {
+	parts := make([]string, 0, 2*len(metric.Label))
+	for _, label := range metric.Label {
+		parts = append(parts, label.GetName(), label.GetValue())
+	}
+	return strings.Join(parts, "\x00")
+}
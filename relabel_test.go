@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRelabeler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test"}, []string{"cluster", "node", "query_type"})
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("prod", "n1.example.com", "SELECT").Set(1)
+	gauge.WithLabelValues("prod", "n1.example.com", "INSERT").Set(2)
+	gauge.WithLabelValues("prod", "test.example.com", "SELECT").Set(3)
+	gauge.WithLabelValues("other", "n1.example.com", "SELECT").Set(4)
+	relabeler := &relabeler{gatherer: registry}
+	relabeler.set(map[string]clusterLabels{
+		"prod": newClusterLabels(map[string]string{"region": "eu"}, []relabelRule{
+			{Label: "node", Action: "drop", Regex: "test\\..*"},
+			{Label: "node", Regex: "(.*)\\.example\\.com"},
+			{Label: "query_type", Action: "keep", Regex: "SELECT|UPDATE"},
+		}),
+	})
+	families, err := relabeler.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	series := []string{}
+	for _, metric := range families[0].Metric {
+		labels := []string{}
+		for _, label := range metric.Label {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		series = append(series, strings.Join(labels, ","))
+	}
+	expected := []string{
+		"cluster=other,node=n1.example.com,query_type=SELECT",
+		"cluster=prod,node=n1,query_type=SELECT,region=eu",
+	}
+	if strings.Join(series, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected series %v, found %v", expected, series)
+	}
+}
+
+func TestRelabelerCollisions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Test"}, []string{"cluster", "node"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("collide", "n1.dc1.example.com").Add(1)
+	counter.WithLabelValues("collide", "n1.dc2.example.com").Add(2)
+	counter.WithLabelValues("collide", "n2.dc1.example.com").Add(3)
+	relabeler := &relabeler{gatherer: registry}
+	relabeler.set(map[string]clusterLabels{
+		"collide": newClusterLabels(nil, []relabelRule{{Label: "node", Regex: "([^.]*)\\..*"}}),
+	})
+	before, _ := relabelCollisions.GetMetricWithLabelValues("collide")
+	var initial dto.Metric
+	before.Write(&initial)
+	families, err := relabeler.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 || families[0].Metric[0].GetCounter().GetValue() != 3 {
+		t.Errorf("Expected only the series of n2 to be kept, found %v", families)
+	}
+	var collisions dto.Metric
+	before.Write(&collisions)
+	if dropped := collisions.GetCounter().GetValue() - initial.GetCounter().GetValue(); dropped != 2 {
+		t.Errorf("Expected 2 series dropped by collisions, found %v", dropped)
+	}
+	relabelCollisions.DeleteLabelValues("collide")
+}
+
+func TestCheckLabelName(t *testing.T) {
+	for _, label := range []struct {
+		name     string
+		reserved bool
+	}{
+		{"cluster", true},
+		{"bucket", true},           // cb_bucket_info
+		{"scan_consistency", true}, // n1ql_active_queries
+		{"source_bucket", true},    // XDCR replications
+		{"le", true},
+		{"quantile", true},
+		{"team", false},
+		{"env", false},
+	} {
+		err := checkLabelName(label.name)
+		if reserved := err != nil; reserved != label.reserved {
+			t.Errorf("%s: expected reserved %v, found %v", label.name, label.reserved, reserved)
+		}
+	}
+	if err := checkLabelName("__name"); err == nil {
+		t.Errorf("Expected names starting with __ to be rejected")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// reloadRequests Configuration reloads asked by SIGHUP, a change of the
+// configuration file or POST /-/reload, handled one at a time by a single
+// goroutine. The result is sent back when the request carries a channel.
+var reloadRequests = make(chan chan error, 1)
+
+// requestReload asks for a reload without waiting, reloads already pending
+// are coalesced
+func requestReload() {
+	select {
+	case reloadRequests <- nil:
+	default:
+	}
+}
+
+// reloadConfiguration reads the configuration again and applies it to the
+// cluster workers by cluster name: new clusters are added, removed ones are
+// stopped and clusters whose definition changed are restarted. Unchanged
+// clusters keep their state.
+func reloadConfiguration(ctx context.Context, workers map[string]*clusterWorker) error {
+	data, err := readConfiguration()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	// The file read is validated and applied, even if it changes meanwhile
+	if problems := validateConfigurationRead(data); len(problems) > 0 {
+		configReloadSuccess.Set(0)
+		return problems
+	}
+	definitions := configurationDefs()
+	if buckets := configuredHistogramSettings().Buckets; len(buckets)+len(histogramsInUse.Buckets) > 0 && !reflect.DeepEqual(buckets, histogramsInUse.Buckets) {
+		log.Printf("Histogram buckets changed, they are only applied on restart\n")
+	}
+	if err := cbapi.SetTLSConfig(getTLSConfig()); err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	running := make(map[string]configuration, len(workers))
+	for name, worker := range workers {
+		running[name] = worker.definition
+	}
+	changes := diffClusters(running, definitions)
+	// Removed clusters go first so their series are gone before a new
+	// cluster takes their label
+	for _, name := range changes.removed {
+		log.Printf("Removing cluster %s\n", name)
+		worker := workers[name]
+		worker.stopAndWait()
+		delete(workers, name)
+		forgetCluster(worker.definition.name)
+	}
+	for _, definition := range changes.changed {
+		name := strings.ToUpper(definition.clusterName)
+		log.Printf("Configuration of cluster %s changed, restarting its monitors\n", name)
+		existing := workers[name]
+		existing.stopAndWait()
+		if existing.definition.name != definition.name {
+			forgetCluster(existing.definition.name)
+		}
+		workers[name] = startClusterWorker(ctx, definition)
+	}
+	for _, definition := range changes.added {
+		name := strings.ToUpper(definition.clusterName)
+		log.Printf("Adding cluster %s\n", name)
+		workers[name] = startClusterWorker(ctx, definition)
+	}
+	clusterRelabeler.set(changes.labels)
+	probeConfig.set(getProbeModules(), getQuantileSettings(), viper.GetInt("preparedtop"))
+	configReloadSuccess.Set(1)
+	configReloadTime.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// clusterChanges Clusters to start, restart and stop to apply a configuration
+type clusterChanges struct {
+	added   []configuration
+	changed []configuration
+	removed []string                 // upper cased cluster keys
+	labels  map[string]clusterLabels // cluster label -> labels
+}
+
+// diffClusters matches the definitions to the running clusters by their
+// upper cased key, only the first definition of a key is used
+func diffClusters(running map[string]configuration, definitions []configuration) clusterChanges {
+	changes := clusterChanges{labels: make(map[string]clusterLabels)}
+	current := make(map[string]bool)
+	for _, definition := range definitions {
+		name := strings.ToUpper(definition.clusterName)
+		if current[name] {
+			log.Printf("Cluster %s is defined more than once, ignoring %s\n", name, definition.clusterName)
+			continue
+		}
+		current[name] = true
+		changes.labels[definition.name] = newClusterLabels(definition.labels, definition.relabel)
+		existing, found := running[name]
+		switch {
+		case !found:
+			changes.added = append(changes.added, definition)
+		case !reflect.DeepEqual(withoutLabels(existing), withoutLabels(definition)):
+			changes.changed = append(changes.changed, definition)
+		}
+	}
+	for name := range running {
+		if !current[name] {
+			changes.removed = append(changes.removed, name)
+		}
+	}
+	sort.Strings(changes.removed)
+	return changes
+}
+
+// withoutLabels drops the labels of a definition, they are applied when the
+// metrics are gathered and changing them doesn't restart the monitors
+func withoutLabels(definition configuration) configuration {
+	definition.labels = nil
+	definition.relabel = nil
+	return definition
+}
+
+// clusterVector Metric vector labeled by cluster
+type clusterVector interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+// clusterVectors returns every metric vector with a cluster label, the
+// histograms only once they are built
+func clusterVectors() []clusterVector {
+	vectors := []clusterVector{
+		nodeStatus, nodeMembership, nodeRecoveryType, nodeInfo,
+		nodeCPUUtilization, nodeCPUCount, nodeMemoryTotal, nodeMemoryFree, nodeSwapTotal, nodeSwapUsed, nodeUptime,
+		rebalanceRunning, rebalanceProgress, rebalanceLastOutcome,
+		autoFailoverEnabled, autoFailoverTimeout, autoFailoverCount, autoFailoverMaxCount,
+		bucketInfo, bucketRAMQuota, bucketMemoryUsed, bucketItems, bucketDiskUsed, bucketDataUsed,
+		scrapeIntervalSeconds, scrapeDuration, relabelCollisions,
+	}
+	return append(vectors, scrapeMetrics.vectors()...)
+}
+
+// deleteSeries deletes the series of a vector having every label of match
+func deleteSeries(vector clusterVector, match prometheus.Labels) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		vector.Collect(metrics)
+		close(metrics)
+	}()
+	// The vector can't be changed while it is being collected
+	matches := []prometheus.Labels{}
+	for metric := range metrics {
+		var written dto.Metric
+		if err := metric.Write(&written); err != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(written.Label))
+		for _, pair := range written.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		matched := true
+		for name, value := range match {
+			matched = matched && labels[name] == value
+		}
+		if matched {
+			matches = append(matches, labels)
+		}
+	}
+	for _, labels := range matches {
+		vector.Delete(labels)
+	}
+}
+
+// forgetCluster removes every series of a cluster that is not monitored
+// anymore or was renamed
+func forgetCluster(clusterName string) {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	for _, vector := range clusterVectors() {
+		deleteSeries(vector, prometheus.Labels{"cluster": clusterName})
+	}
+	delete(reportedBuckets, clusterName)
+	delete(reportedNodes, clusterName)
+	scrapeMetrics.forget(clusterName)
+	clusterReplications.forget(clusterName)
+}
+
+// reloadHandler reloads the configuration on POST /-/reload
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result := make(chan error, 1)
+	reloadRequests <- result
+	if err := <-result; err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload configuration: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// watchReloadSignals reloads the configuration on SIGHUP and when the
+// configuration file changes
+func watchReloadSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Received SIGHUP, reloading configuration\n")
+			requestReload()
+		}
+	}()
+	configFile := viper.ConfigFileUsed()
+	if configFile == "" {
+		return
+	}
+	configFile, _ = filepath.Abs(configFile)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Cannot watch the configuration file: %s\n", err.Error())
+		return
+	}
+	// The directory is watched since editors and Kubernetes config maps
+	// replace the file instead of writing it
+	configDir := filepath.Dir(configFile)
+	if err := watcher.Add(configDir); err != nil {
+		log.Printf("Cannot watch the configuration file: %s\n", err.Error())
+		watcher.Close()
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event := <-watcher.Events:
+				name, _ := filepath.Abs(event.Name)
+				if name == configFile || filepath.Base(name) == "..data" {
+					log.Printf("Configuration file changed, reloading configuration\n")
+					requestReload()
+				}
+			case err := <-watcher.Errors:
+				log.Printf("Error watching the configuration file: %s\n", err.Error())
+			}
+		}
+	}()
+}
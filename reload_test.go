@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+func TestDiffClusters(t *testing.T) {
+	running := map[string]configuration{
+		"KEPT":    {clusterName: "kept", name: "KEPT", hosts: []string{"h1"}},
+		"CHANGED": {clusterName: "changed", name: "CHANGED", hosts: []string{"h2"}},
+		"LABELED": {clusterName: "labeled", name: "LABELED", hosts: []string{"h3"}},
+		"REMOVED": {clusterName: "removed", name: "REMOVED", hosts: []string{"h4"}},
+	}
+	definitions := []configuration{
+		{clusterName: "kept", name: "KEPT", hosts: []string{"h1"}},
+		{clusterName: "changed", name: "CHANGED", hosts: []string{"h2", "h5"}},
+		{clusterName: "labeled", name: "LABELED", hosts: []string{"h3"}, labels: map[string]string{"env": "prod"}},
+		{clusterName: "added", name: "ADDED", hosts: []string{"h6"}},
+		{clusterName: "ADDED", name: "OTHER", hosts: []string{"h7"}},
+	}
+	changes := diffClusters(running, definitions)
+	if len(changes.added) != 1 || changes.added[0].hosts[0] != "h6" {
+		t.Errorf("Expected only the first definition of ADDED to be added, found %+v", changes.added)
+	}
+	if len(changes.changed) != 1 || changes.changed[0].clusterName != "changed" {
+		t.Errorf("Expected only CHANGED to be restarted, found %+v", changes.changed)
+	}
+	if strings.Join(changes.removed, ",") != "REMOVED" {
+		t.Errorf("Expected only REMOVED to be removed, found %v", changes.removed)
+	}
+	if len(changes.labels) != 4 || changes.labels["LABELED"].static["env"] != "prod" {
+		t.Errorf("Unexpected labels %+v", changes.labels)
+	}
+}
+
+func TestReloadInvalidConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "n1qlexporter")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile = filepath.Join(dir, "settings.json")
+	defer func() {
+		configFile = ""
+		viper.Reset()
+	}()
+	ioutil.WriteFile(configFile, []byte(`{"clusters": {"c1": "http://host1"}}`), 0600)
+	configReloadSuccess.Set(1)
+	workers := make(map[string]*clusterWorker)
+	if err := reloadConfiguration(context.Background(), workers); err == nil {
+		t.Fatalf("Expected the invalid configuration to be rejected")
+	}
+	var success dto.Metric
+	configReloadSuccess.Write(&success)
+	if success.GetGauge().GetValue() != 0 {
+		t.Errorf("Expected n1ql_exporter_config_last_reload_successful to be 0")
+	}
+	if len(workers) != 0 {
+		t.Errorf("Expected no cluster to be started, found %d", len(workers))
+	}
+}
+
+func TestForgetCluster(t *testing.T) {
+	rebalanceRunning.WithLabelValues("GONE").Set(1)
+	rebalanceRunning.WithLabelValues("KEPT").Set(1)
+	scrapeMetrics.activeOverThreshold.WithLabelValues("GONE", "n1", "", "10").Set(2)
+	scrapeMetrics.scrapeTimeouts.WithLabelValues("GONE", "n1", "").Inc()
+	forgetCluster("GONE")
+	defer forgetCluster("KEPT")
+	kept := 0
+	for _, vector := range []clusterVector{rebalanceRunning, scrapeMetrics.activeOverThreshold, scrapeMetrics.scrapeTimeouts} {
+		metrics := make(chan prometheus.Metric, 10)
+		vector.Collect(metrics)
+		close(metrics)
+		for metric := range metrics {
+			var written dto.Metric
+			metric.Write(&written)
+			for _, pair := range written.Label {
+				if pair.GetName() == "cluster" && pair.GetValue() == "GONE" {
+					t.Errorf("Expected the series of GONE to be deleted, found %s", written.String())
+				}
+				if pair.GetName() == "cluster" && pair.GetValue() == "KEPT" {
+					kept++
+				}
+			}
+		}
+	}
+	if kept != 1 {
+		t.Errorf("Expected the series of KEPT to be kept, found %d", kept)
+	}
+}
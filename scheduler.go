@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reportMutex Serializes the reports of the cluster workers, the series
+// reported per cluster are tracked in shared maps
+var reportMutex sync.Mutex
+
+// clusterWorker Goroutine scraping a cluster on its own schedule so a slow
+// cluster doesn't delay the others
+type clusterWorker struct {
+	definition configuration
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// startClusterWorker discovers the cluster and scrapes it until stopped or
+// ctx is done
+func startClusterWorker(ctx context.Context, definition configuration) *clusterWorker {
+	ctx, cancel := context.WithCancel(ctx)
+	worker := &clusterWorker{
+		definition: definition,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go worker.run(ctx)
+	return worker
+}
+
+// stopAndWait stops the worker, aborting the scrape in progress
+func (w *clusterWorker) stopAndWait() {
+	w.cancel()
+	<-w.done
+}
+
+// sleep waits unless ctx is done first
+func sleep(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// jittered moves an interval randomly by up to jitter times the interval in
+// either direction
+func jittered(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+}
+
+func (w *clusterWorker) run(ctx context.Context) {
+	defer close(w.done)
+	settings := w.definition.scrape
+	// Spread the first scrapes so the clusters aren't scraped all at once
+	if !sleep(ctx, time.Duration(rand.Float64()*settings.jitter*float64(settings.interval))) {
+		return
+	}
+	monitor, err := newClusterMonitor(ctx, w.definition)
+	if err != nil {
+		log.Printf("Cannot discover cluster %s: %s\n", w.definition.clusterName, err.Error())
+	}
+	clusterName := w.definition.name
+	scrapeIntervalSeconds.WithLabelValues(clusterName).Set(monitor.interval.Seconds())
+	lastRenew := time.Now()
+	for {
+		if time.Since(lastRenew) >= renewInterval {
+			monitor.renew(ctx)
+			lastRenew = time.Now()
+		}
+		start := time.Now()
+		monitor.execute(ctx)
+		scrapeDuration.WithLabelValues(clusterName).Set(time.Since(start).Seconds())
+		if !sleep(ctx, jittered(monitor.interval, settings.jitter)-time.Since(start)) {
+			return
+		}
+	}
+}
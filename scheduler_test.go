@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScrapeSettings(t *testing.T) {
+	interval := 30
+	global := (&scrapeOptions{Interval: "1m", Timeout: "20s"}).apply(defaultScrapeSettings)
+	cluster := (&scrapeOptions{Interval: "10s", Concurrency: &interval}).apply(global)
+	if cluster.interval != 10*time.Second || cluster.concurrency != 30 || cluster.jitter != defaultScrapeSettings.jitter {
+		t.Errorf("Unexpected cluster scrape settings %+v", cluster)
+	}
+	if timeout := cluster.nodeTimeout(cluster.interval); timeout != 10*time.Second {
+		t.Errorf("Expected the inherited timeout to be bounded by the interval, found %s", timeout)
+	}
+	if timeout := global.nodeTimeout(global.interval); timeout != 20*time.Second {
+		t.Errorf("Expected a 20s timeout, found %s", timeout)
+	}
+	for ndx := 0; ndx < 100; ndx++ {
+		if wait := jittered(10*time.Second, 0.1); wait < 9*time.Second || wait > 11*time.Second {
+			t.Fatalf("Jittered interval %s out of bounds", wait)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+)
+
+// settingsFile Layout of the configuration file, settings.schema.json is
+// generated from it with the schema command
+type settingsFile struct {
+	credentials
+	UseHTTPS              bool                    `json:"usehttps" description:"Connect to every cluster with HTTPS"`
+	TLS                   cbapi.TLSConfig         `json:"tls" description:"Certificates used to connect to the clusters"`
+	Clusters              map[string]clusterEntry `json:"clusters" schema:"required" description:"Clusters by name"`
+	PreparedTop           int                     `json:"preparedtop" description:"Prepared statements reported per node"`
+	LongRunningThresholds []string                `json:"longrunningthresholds" description:"Durations of the long running queries gauges"`
+	Histograms            histogramSettings       `json:"histograms" description:"Histogram buckets by metric name"`
+	Quantiles             quantileOptions         `json:"quantiles" description:"Completed requests quantiles"`
+	Modules               map[string]probeModule  `json:"modules" description:"Credentials of the /probe endpoint modules"`
+	Scrape                scrapeOptions           `json:"scrape" description:"Scrape schedule of every cluster, clusters can override it"`
+	Labels                map[string]string       `json:"labels" description:"Static labels added to the series of every cluster"`
+	Relabel               []relabelRule           `json:"relabel" description:"Relabeling rules applied to the series of every cluster before their own"`
+}
+
+// clusterEntry A cluster is a comma separated list of hosts or an object
+type clusterEntry struct{}
+
+func (clusterEntry) jsonSchema(g *schemaGenerator) map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{
+				"type":        "string",
+				"description": "Comma separated list of hosts, without protocol or port",
+			},
+			g.schema(reflect.TypeOf(clusterOptions{})),
+		},
+	}
+}
+
+// customSchema Types whose schema can not be derived from their fields
+type customSchema interface {
+	jsonSchema(g *schemaGenerator) map[string]interface{}
+}
+
+var customSchemaType = reflect.TypeOf((*customSchema)(nil)).Elem()
+
+type schemaGenerator struct{}
+
+// schema describes a Go type as it is decoded from the configuration, fields
+// are named after their json tag, the schema:"required" ones are required and
+// enum lists the values allowed
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t.Implements(customSchemaType) {
+		return reflect.Zero(t).Interface().(customSchema).jsonSchema(g)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		g.fields(t, properties, &required)
+		object := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			object["required"] = required
+		}
+		return object
+	}
+	// interface{} accepts any value
+	return map[string]interface{}{}
+}
+
+// fields adds the properties of a struct, embedded structs are flattened as
+// encoding/json does
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for ndx := 0; ndx < t.NumField(); ndx++ {
+		field := t.Field(ndx)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			g.fields(field.Type, properties, required)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || name == "" {
+			continue
+		}
+		property := g.schema(field.Type)
+		if description := field.Tag.Get("description"); description != "" {
+			property["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			property["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = property
+		if field.Tag.Get("schema") == "required" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// configurationSchema returns the JSON Schema of the configuration file
+func configurationSchema() ([]byte, error) {
+	g := &schemaGenerator{}
+	schema := g.schema(reflect.TypeOf(settingsFile{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "n1qlExporter configuration"
+	encoded, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, '\n'), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/elfido/n1qlExporter/n1qlmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Query service vitals are cumulative or point in time values computed by the
+// query service itself, so they are exported as-is from the last scrape
+// instead of being accumulated in metric vectors.
+var vitalsLabels = []string{"cluster", "node", "server_group"}
+
+var (
+	vitalsCompletedDesc = prometheus.NewDesc("n1ql_vitals_requests_completed_total",
+		"N1QL requests completed since the query service started", vitalsLabels, nil)
+	vitalsActiveDesc = prometheus.NewDesc("n1ql_vitals_requests_active",
+		"N1QL requests currently active", vitalsLabels, nil)
+	vitalsRequestRateDesc = prometheus.NewDesc("n1ql_vitals_requests_per_second",
+		"N1QL request rate per window (1m, 5m or 15m)", append(vitalsLabels, "window"), nil)
+	vitalsRequestTimeDesc = prometheus.NewDesc("n1ql_vitals_request_time_seconds",
+		"N1QL request time percentiles computed by the query service", append(vitalsLabels, "percentile"), nil)
+	vitalsRequestTimeMeanDesc = prometheus.NewDesc("n1ql_vitals_request_time_mean_seconds",
+		"N1QL mean request time computed by the query service", vitalsLabels, nil)
+	vitalsPreparedDesc = prometheus.NewDesc("n1ql_vitals_prepared_requests_percent",
+		"N1QL percentage of requests using prepared statements", vitalsLabels, nil)
+	vitalsUptimeDesc = prometheus.NewDesc("n1ql_vitals_uptime_seconds",
+		"N1QL query service uptime", vitalsLabels, nil)
+	vitalsCoresDesc = prometheus.NewDesc("n1ql_vitals_cores",
+		"N1QL cores available to the query service", vitalsLabels, nil)
+	vitalsGoroutinesDesc = prometheus.NewDesc("n1ql_vitals_goroutines",
+		"N1QL query service goroutines", vitalsLabels, nil)
+	vitalsLoadDesc = prometheus.NewDesc("n1ql_vitals_load",
+		"N1QL query service load", vitalsLabels, nil)
+	vitalsMemoryUsageDesc = prometheus.NewDesc("n1ql_vitals_memory_usage_bytes",
+		"N1QL query service heap in use", vitalsLabels, nil)
+	vitalsMemorySystemDesc = prometheus.NewDesc("n1ql_vitals_memory_system_bytes",
+		"N1QL query service memory obtained from the system", vitalsLabels, nil)
+	vitalsMemoryTotalDesc = prometheus.NewDesc("n1ql_vitals_memory_allocated_bytes_total",
+		"N1QL query service memory allocated since it started", vitalsLabels, nil)
+	vitalsGCCountDesc = prometheus.NewDesc("n1ql_vitals_gc_runs_total",
+		"N1QL query service garbage collections since it started", vitalsLabels, nil)
+	vitalsGCPauseDesc = prometheus.NewDesc("n1ql_vitals_gc_pause_seconds_total",
+		"N1QL query service garbage collection pause time since it started", vitalsLabels, nil)
+	vitalsGCPausePercentDesc = prometheus.NewDesc("n1ql_vitals_gc_pause_percent",
+		"N1QL query service percentage of time spent in garbage collection pauses", vitalsLabels, nil)
+)
+
+type nodeVitals struct {
+	labels []string
+	vitals n1qlmonitor.Vitals
+}
+
+// vitalsCollector exports the last vitals read per cluster and node
+type vitalsCollector struct {
+	mutex sync.Mutex
+	nodes map[string]map[string]nodeVitals
+}
+
+// update replaces the vitals of a cluster, nodes without vitals are dropped
+func (c *vitalsCollector) update(metrics *n1qlmonitor.ClusterResponse, serverGroups map[string]string) {
+	nodes := make(map[string]nodeVitals)
+	for _, server := range metrics.ServerResponses {
+		if server.Vitals.Collected {
+			nodes[server.Node] = nodeVitals{
+				labels: []string{metrics.ClusterName, server.Node, serverGroups[server.Node]},
+				vitals: server.Vitals,
+			}
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nodes[metrics.ClusterName] = nodes
+}
+
+// forget drops the vitals of a cluster that is not monitored anymore
+func (c *vitalsCollector) forget(clusterName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.nodes, clusterName)
+}
+
+// Describe implements prometheus.Collector
+func (c *vitalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vitalsCompletedDesc
+	ch <- vitalsActiveDesc
+	ch <- vitalsRequestRateDesc
+	ch <- vitalsRequestTimeDesc
+	ch <- vitalsRequestTimeMeanDesc
+	ch <- vitalsPreparedDesc
+	ch <- vitalsUptimeDesc
+	ch <- vitalsCoresDesc
+	ch <- vitalsGoroutinesDesc
+	ch <- vitalsLoadDesc
+	ch <- vitalsMemoryUsageDesc
+	ch <- vitalsMemorySystemDesc
+	ch <- vitalsMemoryTotalDesc
+	ch <- vitalsGCCountDesc
+	ch <- vitalsGCPauseDesc
+	ch <- vitalsGCPausePercentDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *vitalsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, nodes := range c.nodes {
+		for _, node := range nodes {
+			v := node.vitals
+			gauge := func(desc *prometheus.Desc, value float64, extra ...string) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(node.labels, extra...)...)
+			}
+			counter := func(desc *prometheus.Desc, value float64) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, node.labels...)
+			}
+			counter(vitalsCompletedDesc, v.CompletedCount)
+			gauge(vitalsActiveDesc, v.ActiveCount)
+			gauge(vitalsRequestRateDesc, v.RequestRate1Min, "1m")
+			gauge(vitalsRequestRateDesc, v.RequestRate5Min, "5m")
+			gauge(vitalsRequestRateDesc, v.RequestRate15Min, "15m")
+			gauge(vitalsRequestTimeDesc, v.RequestTimeMedian, "0.5")
+			gauge(vitalsRequestTimeDesc, v.RequestTime80, "0.8")
+			gauge(vitalsRequestTimeDesc, v.RequestTime95, "0.95")
+			gauge(vitalsRequestTimeDesc, v.RequestTime99, "0.99")
+			gauge(vitalsRequestTimeMeanDesc, v.RequestTimeMean)
+			gauge(vitalsPreparedDesc, v.PreparedPercent)
+			gauge(vitalsUptimeDesc, v.Uptime)
+			gauge(vitalsCoresDesc, v.Cores)
+			gauge(vitalsGoroutinesDesc, v.Goroutines)
+			gauge(vitalsLoadDesc, v.Load)
+			gauge(vitalsMemoryUsageDesc, v.MemoryUsage)
+			gauge(vitalsMemorySystemDesc, v.MemorySystem)
+			counter(vitalsMemoryTotalDesc, v.MemoryTotal)
+			counter(vitalsGCCountDesc, v.GCCount)
+			counter(vitalsGCPauseDesc, v.GCPause)
+			gauge(vitalsGCPausePercentDesc, v.GCPausePercent)
+		}
+	}
+}
+
+func initVitalsMetrics() {
+	registerMetrics(scrapeMetrics.vitals)
+}
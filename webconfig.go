@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// webConfig Listener settings read from -web.config.file, in the format of
+// the Prometheus exporters web configuration
+type webConfig struct {
+	TLSServerConfig *webTLSConfig     `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"` // user -> bcrypt hash
+}
+
+// webTLSConfig Certificate of the listener and verification of the client
+// certificates
+type webTLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"` // NoClientCert by default
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"` // TLS12 by default
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+}
+
+// readWebConfig reads and checks the web configuration, an empty path
+// keeps the listener on plain HTTP without authentication
+func readWebConfig(path string) (*webConfig, error) {
+	config := &webConfig{}
+	if path == "" {
+		return config, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// validate returns the problems found in the web configuration
+func (c *webConfig) validate() []string {
+	problems := []string{}
+	if t := c.TLSServerConfig; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			problems = append(problems, "tls_server_config: cert_file and key_file are required")
+		} else if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+			problems = append(problems, "tls_server_config: "+err.Error())
+		}
+		clientAuth, found := clientAuthTypes[t.ClientAuthType]
+		if t.ClientAuthType != "" && !found {
+			problems = append(problems, fmt.Sprintf("tls_server_config.client_auth_type: unknown type %q", t.ClientAuthType))
+		}
+		verifies := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+		if verifies && t.ClientCAFile == "" {
+			problems = append(problems, "tls_server_config.client_ca_file: required to verify the client certificates")
+		}
+		if t.ClientCAFile != "" {
+			if _, err := t.clientCAs(); err != nil {
+				problems = append(problems, "tls_server_config.client_ca_file: "+err.Error())
+			}
+		}
+		if t.MinVersion == "TLS13" {
+			// The builder image is Go 1.11, its crypto/tls never negotiates TLS 1.3
+			problems = append(problems, "tls_server_config.min_version: TLS13 is not supported by this build")
+		} else if _, found := tlsVersions[t.MinVersion]; t.MinVersion != "" && !found {
+			problems = append(problems, fmt.Sprintf("tls_server_config.min_version: unknown version %q", t.MinVersion))
+		}
+	}
+	users := make([]string, 0, len(c.BasicAuthUsers))
+	for user := range c.BasicAuthUsers {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		if _, err := bcrypt.Cost([]byte(c.BasicAuthUsers[user])); err != nil {
+			problems = append(problems, fmt.Sprintf("basic_auth_users.%s: not a bcrypt hash", user))
+		}
+	}
+	return problems
+}
+
+func (t *webTLSConfig) clientCAs() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", t.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS settings of the listener, nil without
+// tls_server_config
+func (c *webConfig) tlsConfig() (*tls.Config, error) {
+	t := c.TLSServerConfig
+	if t == nil {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuthTypes[t.ClientAuthType],
+	}
+	if t.MinVersion != "" {
+		config.MinVersion = tlsVersions[t.MinVersion]
+	}
+	if t.ClientCAFile != "" {
+		pool, err := t.clientCAs()
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+	}
+	certificate := &reloadingCertificate{certFile: t.CertFile, keyFile: t.KeyFile}
+	if _, err := certificate.get(nil); err != nil {
+		return nil, err
+	}
+	config.GetCertificate = certificate.get
+	return config, nil
+}
+
+// reloadingCertificate Certificate of the listener, read again when its files
+// change so renewed certificates are served without a restart
+type reloadingCertificate struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+func (r *reloadingCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	modified := time.Time{}
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	if r.certificate != nil && !modified.After(r.modified) {
+		return r.certificate, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.certificate != nil {
+			// Keep serving the previous certificate while the files are rewritten
+			return r.certificate, nil
+		}
+		return nil, err
+	}
+	r.certificate = &certificate
+	r.modified = modified
+	return r.certificate, nil
+}
+
+// unauthenticatedPaths Probe endpoints answering without credentials, they
+// expose no data
+var unauthenticatedPaths = map[string]bool{
+	"/-/healthy": true,
+	"/-/ready":   true,
+}
+
+// dummyHash Compared against for unknown users so they take as long as the
+// known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("n1qlExporter"), bcrypt.DefaultCost)
+
+// basicAuth Handler requiring one of the basic_auth_users, the successful
+// checks are cached since bcrypt is slow on purpose
+type basicAuth struct {
+	users   map[string]string
+	handler http.Handler
+	mutex   sync.Mutex
+	valid   map[[sha256.Size]byte]bool
+}
+
+// authenticate wraps handler with the basic authentication, when users are
+// configured
+func (c *webConfig) authenticate(handler http.Handler) http.Handler {
+	if len(c.BasicAuthUsers) == 0 {
+		return handler
+	}
+	return &basicAuth{
+		users:   c.BasicAuthUsers,
+		handler: handler,
+		valid:   make(map[[sha256.Size]byte]bool),
+	}
+}
+
+func (b *basicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if unauthenticatedPaths[r.URL.Path] {
+		b.handler.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || !b.check(user, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="n1qlExporter"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	b.handler.ServeHTTP(w, r)
+}
+
+func (b *basicAuth) check(user string, password string) bool {
+	hash, found := b.users[user]
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	b.mutex.Lock()
+	cached := b.valid[key]
+	b.mutex.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	b.mutex.Lock()
+	b.valid[key] = true
+	b.mutex.Unlock()
+	return true
+}
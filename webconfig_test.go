@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "n1qlexporter")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "invalid.yml")
+	ioutil.WriteFile(invalid, []byte(`
+tls_server_config:
+  client_auth_type: RequireAndVerifyClientCert
+  min_version: TLS09
+basic_auth_users:
+  alice: secret
+`), 0600)
+	_, err = readWebConfig(invalid)
+	if err == nil {
+		t.Fatalf("Expected an invalid web configuration")
+	}
+	for _, problem := range []string{"cert_file and key_file are required", "client_ca_file: required", "unknown version \"TLS09\"", "basic_auth_users.alice: not a bcrypt hash"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in %s", problem, err.Error())
+		}
+	}
+
+	tls13 := filepath.Join(dir, "tls13.yml")
+	ioutil.WriteFile(tls13, []byte("tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  min_version: TLS13\n"), 0600)
+	if _, err := readWebConfig(tls13); err == nil || !strings.Contains(err.Error(), "TLS13 is not supported") {
+		t.Errorf("Expected TLS13 to be rejected, found %v", err)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	valid := filepath.Join(dir, "valid.yml")
+	ioutil.WriteFile(valid, []byte("basic_auth_users:\n  alice: "+string(hash)+"\n"), 0600)
+	web, err := readWebConfig(valid)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	handler := web.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, request := range []struct {
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{"/metrics", "", "", http.StatusUnauthorized},
+		{"/metrics", "alice", "queen", http.StatusUnauthorized},
+		{"/metrics", "bob", "wonderland", http.StatusUnauthorized},
+		{"/metrics", "alice", "wonderland", http.StatusOK},
+		{"/metrics", "alice", "wonderland", http.StatusOK},
+		{"/-/healthy", "", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", request.path, nil)
+		if request.user != "" {
+			r.SetBasicAuth(request.user, request.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != request.status {
+			t.Errorf("%s as %q: expected status %d, found %d", request.path, request.user, request.status, w.Code)
+		}
+	}
+}
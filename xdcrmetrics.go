@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/elfido/n1qlExporter/xdcrmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var replicationStatuses = []string{"running", "paused", "notRunning"}
+
+// XDCR replications are exported as-is from the last scrape, the documents
+// counts are cumulative since the replication started
+var replicationLabels = []string{"cluster", "target_cluster", "source_bucket", "target_bucket"}
+
+var (
+	replicationStatusDesc = prometheus.NewDesc("cb_xdcr_replication_status",
+		"XDCR replication status (running, paused or notRunning)", append(replicationLabels, "status"), nil)
+	replicationErrorsDesc = prometheus.NewDesc("cb_xdcr_replication_errors",
+		"XDCR replication errors currently reported", replicationLabels, nil)
+	replicationChangesLeftDesc = prometheus.NewDesc("cb_xdcr_changes_left",
+		"XDCR mutations pending replication", replicationLabels, nil)
+	replicationDocsWrittenDesc = prometheus.NewDesc("cb_xdcr_docs_written_total",
+		"XDCR documents written to the target since the replication started", replicationLabels, nil)
+	replicationDocsFailedDesc = prometheus.NewDesc("cb_xdcr_docs_failed_cr_source_total",
+		"XDCR documents not replicated because they failed conflict resolution at the source", replicationLabels, nil)
+	replicationDocsFilteredDesc = prometheus.NewDesc("cb_xdcr_docs_filtered_total",
+		"XDCR documents filtered out by the replication filter", replicationLabels, nil)
+	replicationBandwidthDesc = prometheus.NewDesc("cb_xdcr_bandwidth_bytes_per_second",
+		"XDCR bandwidth used by the replication", replicationLabels, nil)
+	replicationDocsLatencyDesc = prometheus.NewDesc("cb_xdcr_docs_latency_seconds",
+		"XDCR weighted average latency for sending documents", replicationLabels, nil)
+	replicationMetaLatencyDesc = prometheus.NewDesc("cb_xdcr_meta_latency_seconds",
+		"XDCR weighted average latency for sending metadata", replicationLabels, nil)
+)
+
+// xdcrCollector exports the last replications read per cluster
+type xdcrCollector struct {
+	mutex    sync.Mutex
+	clusters map[string][]xdcrmonitor.ReplicationStatus
+}
+
+var clusterReplications = &xdcrCollector{
+	clusters: make(map[string][]xdcrmonitor.ReplicationStatus),
+}
+
+// update replaces the replications of a cluster, the last ones read are kept
+// when no server answered
+func (c *xdcrCollector) update(metrics *xdcrmonitor.ClusterResponse) {
+	if !metrics.Collected {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clusters[metrics.ClusterName] = metrics.Replications
+}
+
+// forget drops the replications of a cluster that is not monitored anymore
+func (c *xdcrCollector) forget(clusterName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.clusters, clusterName)
+}
+
+// Describe implements prometheus.Collector
+func (c *xdcrCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replicationStatusDesc
+	ch <- replicationErrorsDesc
+	ch <- replicationChangesLeftDesc
+	ch <- replicationDocsWrittenDesc
+	ch <- replicationDocsFailedDesc
+	ch <- replicationDocsFilteredDesc
+	ch <- replicationBandwidthDesc
+	ch <- replicationDocsLatencyDesc
+	ch <- replicationMetaLatencyDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *xdcrCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for clusterName, replications := range c.clusters {
+		for _, replication := range replications {
+			labels := []string{clusterName, replication.TargetCluster, replication.SourceBucket, replication.TargetBucket}
+			gauge := func(desc *prometheus.Desc, value float64, extra ...string) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(labels, extra...)...)
+			}
+			counter := func(desc *prometheus.Desc, value float64) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+			}
+			found := false
+			for _, status := range replicationStatuses {
+				found = found || status == replication.Status
+			}
+			for _, status := range replicationStatuses {
+				gauge(replicationStatusDesc, boolToFloat(status == replication.Status), status)
+			}
+			if !found && replication.Status != "" {
+				gauge(replicationStatusDesc, 1, replication.Status)
+			}
+			gauge(replicationErrorsDesc, float64(replication.Errors))
+			gauge(replicationChangesLeftDesc, replication.ChangesLeft)
+			counter(replicationDocsWrittenDesc, replication.DocsWritten)
+			counter(replicationDocsFailedDesc, replication.DocsFailed)
+			counter(replicationDocsFilteredDesc, replication.DocsFiltered)
+			gauge(replicationBandwidthDesc, replication.BandwidthUsage)
+			gauge(replicationDocsLatencyDesc, replication.DocsLatency/1000)
+			gauge(replicationMetaLatencyDesc, replication.MetaLatency/1000)
+		}
+	}
+}
+
+func initXDCRMetrics() {
+	registerMetrics(clusterReplications)
+}
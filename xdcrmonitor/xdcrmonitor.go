@@ -0,0 +1,214 @@
+package xdcrmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/elfido/n1qlExporter/cbapi"
+)
+
+// Monitor XDCR monitoring agent
+type Monitor struct {
+	ClusterName string
+	Servers     []string
+	HTTPAuth    cbapi.Auth
+	protocol    string
+}
+
+// ReplicationStatus State and statistics of a single outgoing replication
+type ReplicationStatus struct {
+	ID             string
+	TargetCluster  string
+	SourceBucket   string
+	TargetBucket   string
+	Status         string
+	Errors         int
+	ChangesLeft    float64
+	DocsWritten    float64
+	DocsFailed     float64
+	DocsFiltered   float64
+	BandwidthUsage float64 // bytes per second
+	DocsLatency    float64 // milliseconds
+	MetaLatency    float64 // milliseconds
+}
+
+// ClusterResponse Collection of replications of a cluster
+type ClusterResponse struct {
+	ClusterName  string
+	Replications []ReplicationStatus
+	Collected    bool // false when no server answered
+}
+
+type remoteClusterResponse struct {
+	Name    string `json:"name"`
+	UUID    string `json:"uuid"`
+	Deleted bool   `json:"deleted"`
+}
+
+type xdcrTaskResponse struct {
+	Type   string        `json:"type"`
+	ID     string        `json:"id"`
+	Source string        `json:"source"`
+	Target string        `json:"target"`
+	Status string        `json:"status"`
+	Errors []interface{} `json:"errors"`
+}
+
+type bucketStatsResponse struct {
+	Op struct {
+		Samples map[string][]float64 `json:"samples"`
+	} `json:"op"`
+}
+
+func getRemoteClusters(ctx context.Context, server string, serverAuth *cbapi.Auth) (map[string]string, error) {
+	url := server + ":8091/pools/default/remoteClusters"
+	var remotes []remoteClusterResponse
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
+	err := json.Unmarshal(bytes, &remotes)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, remote := range remotes {
+		if !remote.Deleted {
+			names[remote.UUID] = remote.Name
+		}
+	}
+	return names, nil
+}
+
+func getReplications(ctx context.Context, server string, serverAuth *cbapi.Auth) ([]xdcrTaskResponse, error) {
+	url := server + ":8091/pools/default/tasks"
+	var tasks []xdcrTaskResponse
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, url, serverAuth)
+	err := json.Unmarshal(bytes, &tasks)
+	if err != nil {
+		return nil, err
+	}
+	replications := make([]xdcrTaskResponse, 0, len(tasks))
+	for _, task := range tasks {
+		if task.Type == "xdcr" {
+			replications = append(replications, task)
+		}
+	}
+	return replications, nil
+}
+
+// getReplicationStats returns the latest sample of every replication stat of a source bucket
+func getReplicationStats(ctx context.Context, server string, serverAuth *cbapi.Auth, bucket string) (map[string]float64, error) {
+	statsURL := server + ":8091/pools/default/buckets/@xdcr-" + url.PathEscape(bucket) + "/stats"
+	var response bucketStatsResponse
+	ctx, cancel := context.WithTimeout(ctx, cbapi.ClusterTimeout)
+	defer cancel()
+	bytes := cbapi.GetAPI(ctx, statsURL, serverAuth)
+	err := json.Unmarshal(bytes, &response)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]float64)
+	for name, samples := range response.Op.Samples {
+		if len(samples) > 0 {
+			stats[name] = samples[len(samples)-1]
+		}
+	}
+	return stats, nil
+}
+
+// parseReplicationID splits a replication id (remoteUUID/sourceBucket/targetBucket)
+func parseReplicationID(id string) (string, string, string) {
+	components := strings.Split(id, "/")
+	if len(components) != 3 {
+		return "", "", ""
+	}
+	return components[0], components[1], components[2]
+}
+
+func (m *Monitor) collect(ctx context.Context, server string) (ClusterResponse, error) {
+	remotes, err := getRemoteClusters(ctx, server, &m.HTTPAuth)
+	if err != nil {
+		return ClusterResponse{}, err
+	}
+	tasks, err := getReplications(ctx, server, &m.HTTPAuth)
+	if err != nil {
+		return ClusterResponse{}, err
+	}
+	bucketStats := make(map[string]map[string]float64)
+	replications := make([]ReplicationStatus, 0, len(tasks))
+	for _, task := range tasks {
+		remoteUUID, sourceBucket, targetBucket := parseReplicationID(task.ID)
+		if sourceBucket == "" {
+			log.Printf("Skipping replication with unexpected id %s\n", task.ID)
+			continue
+		}
+		stats, found := bucketStats[sourceBucket]
+		if !found {
+			stats, err = getReplicationStats(ctx, server, &m.HTTPAuth, sourceBucket)
+			if err != nil {
+				log.Printf("Server: %s\nError getting replication stats for bucket %s:\n%s\n", server, sourceBucket, err.Error())
+				stats = map[string]float64{}
+			}
+			bucketStats[sourceBucket] = stats
+		}
+		targetCluster, found := remotes[remoteUUID]
+		if !found {
+			targetCluster = remoteUUID
+		}
+		prefix := "replications/" + task.ID + "/"
+		replications = append(replications, ReplicationStatus{
+			ID:             task.ID,
+			TargetCluster:  targetCluster,
+			SourceBucket:   sourceBucket,
+			TargetBucket:   targetBucket,
+			Status:         task.Status,
+			Errors:         len(task.Errors),
+			ChangesLeft:    stats[prefix+"changes_left"],
+			DocsWritten:    stats[prefix+"docs_written"],
+			DocsFailed:     stats[prefix+"docs_failed_cr_source"],
+			DocsFiltered:   stats[prefix+"docs_filtered"],
+			BandwidthUsage: stats[prefix+"bandwidth_usage"],
+			DocsLatency:    stats[prefix+"wtavg_docs_latency"],
+			MetaLatency:    stats[prefix+"wtavg_meta_latency"],
+		})
+	}
+	return ClusterResponse{
+		ClusterName:  m.ClusterName,
+		Replications: replications,
+		Collected:    true,
+	}, nil
+}
+
+// Execute Retrieves the replications of the cluster, the first server that answers is used
+func (m *Monitor) Execute(ctx context.Context) ClusterResponse {
+	for _, s := range m.Servers {
+		response, err := m.collect(ctx, m.protocol+"://"+s)
+		if err == nil {
+			return response
+		}
+		log.Printf("Server: %s\nError getting replications:\n%s\n", s, err.Error())
+	}
+	return ClusterResponse{
+		ClusterName:  m.ClusterName,
+		Replications: []ReplicationStatus{},
+	}
+}
+
+// New creates a new XDCR monitor
+func New(clusterName string, servers []string, serverAuth cbapi.Auth, useHTTPS bool) Monitor {
+	protocol := "http"
+	if useHTTPS == true {
+		protocol = "https"
+	}
+	return Monitor{
+		ClusterName: clusterName,
+		Servers:     servers,
+		HTTPAuth:    serverAuth,
+		protocol:    protocol,
+	}
+}